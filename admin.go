@@ -0,0 +1,56 @@
+package throttled
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrAdminNotSupported is returned by administrative operations on a
+// rate limiter whose store does not implement StoreAdminCtx.
+var ErrAdminNotSupported = errors.New("store does not support administrative operations")
+
+// ResetKey clears the stored state of key, returning it to its initial
+// state as if it had never been rate limited. The store must implement
+// StoreAdminCtx.
+func (g *GCRARateLimiterCtx) ResetKey(ctx context.Context, key string) error {
+	admin, ok := g.store.(StoreAdminCtx)
+	if !ok {
+		return ErrAdminNotSupported
+	}
+	return admin.Delete(ctx, key)
+}
+
+// Inspect returns the state of the RateLimiter for key without
+// updating the store. The result is the same as that of RateLimitCtx
+// with a quantity of 0, but no write is performed even for stores that
+// implement the compare-and-swap contract.
+func (g *GCRARateLimiterCtx) Inspect(ctx context.Context, key string) (RateLimitResult, error) {
+	p := g.loadParams()
+	rlc := RateLimitResult{Limit: p.limit, RetryAfter: -1}
+
+	tatVal, now, err := g.store.GetWithTime(ctx, key)
+	if err != nil {
+		return rlc, err
+	}
+
+	tat := now
+	if tatVal != -1 && time.Unix(0, tatVal).After(now) {
+		tat = time.Unix(0, tatVal)
+	}
+
+	// Report state written under a previous quota as RateLimitCtx
+	// would treat it
+	if maxTat := now.Add(p.delayVariationTolerance); tat.After(maxTat) && p.inTransition(now) {
+		tat = maxTat
+	}
+
+	ttl := tat.Sub(now)
+	next := p.delayVariationTolerance - ttl
+	if next > -p.emissionInterval {
+		rlc.Remaining = int(next / p.emissionInterval)
+	}
+	rlc.ResetAfter = ttl
+
+	return rlc, nil
+}
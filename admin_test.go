@@ -0,0 +1,95 @@
+package throttled_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled/v2"
+	"github.com/throttled/throttled/v2/store/memstore"
+)
+
+func TestResetKey(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 0}
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiterCtx(mst, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for i, want := range []bool{false, true} {
+		if limited, _, err := rl.RateLimitCtx(ctx, "foo", 1); err != nil {
+			t.Fatal(err)
+		} else if limited != want {
+			t.Fatalf("%d: expected Limited to be %t but got %t", i, want, limited)
+		}
+	}
+
+	if err := rl.ResetKey(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if limited, _, err := rl.RateLimitCtx(ctx, "foo", 1); err != nil {
+		t.Fatal(err)
+	} else if limited {
+		t.Error("expected a reset key not to be limited")
+	}
+
+	// The store of the limiter must support deleting keys
+	unsupported, err := throttled.NewGCRARateLimiterCtx(&testStore{store: mst}, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unsupported.ResetKey(ctx, "foo"); err != throttled.ErrAdminNotSupported {
+		t.Errorf("expected ErrAdminNotSupported but got %v", err)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 2}
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := testStore{store: mst, clock: time.Unix(0, 0)}
+	rl, err := throttled.NewGCRARateLimiterCtx(&st, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if _, _, err := rl.RateLimitCtx(ctx, "foo", 2); err != nil {
+		t.Fatal(err)
+	}
+	st.clock = st.clock.Add(500 * time.Millisecond)
+
+	// Inspecting works even if the store rejects updates
+	st.failUpdates = true
+	result, err := rl.Inspect(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := throttled.RateLimitResult{Limit: 3, Remaining: 1, ResetAfter: 1500 * time.Millisecond, RetryAfter: -1}
+	if result != want {
+		t.Errorf("expected Inspect to return %+v but got %+v", want, result)
+	}
+
+	st.failUpdates = false
+	if _, peek, err := rl.RateLimitCtx(ctx, "foo", 0); err != nil {
+		t.Fatal(err)
+	} else if peek != result {
+		t.Errorf("expected Inspect to match peeking with %+v but got %+v", peek, result)
+	}
+
+	result, err = rl.Inspect(ctx, "missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = throttled.RateLimitResult{Limit: 3, Remaining: 3, ResetAfter: 0, RetryAfter: -1}
+	if result != want {
+		t.Errorf("expected Inspect of a missing key to return %+v but got %+v", want, result)
+	}
+}
@@ -0,0 +1,314 @@
+package throttled
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by the stores wrapped by a CircuitBreaker
+// instead of calling the underlying store while the circuit is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed is the state in which calls are passed to the store.
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen is the state in which calls fail immediately with
+	// ErrCircuitOpen.
+	CircuitOpen
+
+	// CircuitHalfOpen is the state in which a single call is passed to
+	// the store to probe whether it has recovered.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreakerConfig configures a CircuitBreaker.
+type CircuitBreakerConfig struct {
+	// MaxFailures is the number of consecutive failed calls after which
+	// the circuit opens. Defaults to 5 if zero.
+	MaxFailures int
+
+	// Timeout is the maximum duration of a call. Calls are passed a
+	// context with this deadline, and calls that take longer count as
+	// failed even if they succeed. There is no timeout if it is zero.
+	Timeout time.Duration
+
+	// OpenDuration is how long the circuit stays open before a call is
+	// let through to probe the store. Defaults to 10 seconds if zero.
+	OpenDuration time.Duration
+
+	// OnStateChange, if set, is called whenever the state of the circuit
+	// changes. It must not block, as calls wait for it to return.
+	OnStateChange func(from, to CircuitState)
+}
+
+// CircuitBreaker stops calling a store that keeps failing, so that an
+// unavailable store doesn't slow down every request. A GCRARateLimiterCtx
+// using a wrapped store then fails immediately, which
+// FailSafeRateLimiterCtx can handle according to a FailurePolicy.
+//
+// The circuit opens after MaxFailures consecutive calls have failed or
+// timed out. While it is open, calls fail with ErrCircuitOpen. Once
+// OpenDuration has passed, the circuit becomes half-open and lets a
+// single call through. If it succeeds the circuit closes, otherwise it
+// opens again.
+//
+// Calls that fail because the context passed to them was cancelled or
+// exceeded its deadline don't count as failures, as the store wasn't
+// necessarily at fault.
+type CircuitBreaker struct {
+	config CircuitBreakerConfig
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewCircuitBreaker creates a closed CircuitBreaker.
+func NewCircuitBreaker(config CircuitBreakerConfig) (*CircuitBreaker, error) {
+	if config.MaxFailures < 0 || config.Timeout < 0 || config.OpenDuration < 0 {
+		return nil, errors.New("CircuitBreakerConfig values must not be negative")
+	}
+	if config.MaxFailures == 0 {
+		config.MaxFailures = 5
+	}
+	if config.OpenDuration == 0 {
+		config.OpenDuration = 10 * time.Second
+	}
+	return &CircuitBreaker{config: config}, nil
+}
+
+// State returns the current state of the circuit. An open circuit is
+// reported as open until the next call probes the store.
+func (b *CircuitBreaker) State() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// do calls f unless the circuit is open and records its outcome.
+func (b *CircuitBreaker) do(ctx context.Context, f func(context.Context) error) error {
+	if !b.allow() {
+		return ErrCircuitOpen
+	}
+
+	callCtx := ctx
+	if b.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, b.config.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := f(callCtx)
+	if err != nil && ctx.Err() != nil {
+		b.abandon()
+		return err
+	}
+
+	b.record(err == nil && (b.config.Timeout == 0 || time.Since(start) <= b.config.Timeout))
+	return err
+}
+
+// allow reports whether a call may be made, which makes it the probe if
+// the circuit has been open for long enough.
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	var from CircuitState
+	allowed, changed := true, false
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.config.OpenDuration {
+			allowed = false
+			break
+		}
+		from, changed = b.state, true
+		b.state = CircuitHalfOpen
+		b.probing = true
+	case CircuitHalfOpen:
+		if b.probing {
+			allowed = false
+			break
+		}
+		b.probing = true
+	}
+	b.mu.Unlock()
+
+	if changed {
+		b.notify(from, CircuitHalfOpen)
+	}
+	return allowed
+}
+
+// record records the outcome of a call.
+func (b *CircuitBreaker) record(success bool) {
+	b.mu.Lock()
+	from := b.state
+	// An open circuit isn't affected by calls started before it opened
+	switch b.state {
+	case CircuitClosed:
+		if success {
+			b.failures = 0
+			break
+		}
+		b.failures++
+		if b.failures >= b.config.MaxFailures {
+			b.state = CircuitOpen
+			b.openedAt = time.Now()
+		}
+	case CircuitHalfOpen:
+		b.probing = false
+		b.failures = 0
+		if success {
+			b.state = CircuitClosed
+		} else {
+			b.state = CircuitOpen
+			b.openedAt = time.Now()
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+
+	if from != to {
+		b.notify(from, to)
+	}
+}
+
+// abandon releases the probe of a half-open circuit after a call whose
+// outcome doesn't tell whether the store has recovered.
+func (b *CircuitBreaker) abandon() {
+	b.mu.Lock()
+	if b.state == CircuitHalfOpen {
+		b.probing = false
+	}
+	b.mu.Unlock()
+}
+
+func (b *CircuitBreaker) notify(from, to CircuitState) {
+	if b.config.OnStateChange != nil {
+		b.config.OnStateChange(from, to)
+	}
+}
+
+// WrapStore returns a GCRAStoreCtx that makes the calls to st through
+// the circuit breaker. It implements GCRAStoreAtomicCtx and
+// StoreAdminCtx if st does. Several stores can be wrapped by the same
+// circuit breaker if they fail together, such as stores sharing a
+// connection.
+func (b *CircuitBreaker) WrapStore(st GCRAStoreCtx) GCRAStoreCtx {
+	store := breakerStore{b, st}
+	atomic, isAtomic := st.(GCRAStoreAtomicCtx)
+	admin, isAdmin := st.(StoreAdminCtx)
+	switch {
+	case isAtomic && isAdmin:
+		return breakerAtomicAdminStore{breakerAtomicStore{store, atomic}, breakerAdmin{b, admin}}
+	case isAtomic:
+		return breakerAtomicStore{store, atomic}
+	case isAdmin:
+		return breakerAdminStore{store, breakerAdmin{b, admin}}
+	}
+	return store
+}
+
+type breakerStore struct {
+	breaker *CircuitBreaker
+	store   GCRAStoreCtx
+}
+
+func (s breakerStore) GetWithTime(ctx context.Context, key string) (int64, time.Time, error) {
+	var value int64
+	var now time.Time
+	err := s.breaker.do(ctx, func(ctx context.Context) error {
+		var err error
+		value, now, err = s.store.GetWithTime(ctx, key)
+		return err
+	})
+	return value, now, err
+}
+
+func (s breakerStore) SetIfNotExistsWithTTL(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	var set bool
+	err := s.breaker.do(ctx, func(ctx context.Context) error {
+		var err error
+		set, err = s.store.SetIfNotExistsWithTTL(ctx, key, value, ttl)
+		return err
+	})
+	return set, err
+}
+
+func (s breakerStore) CompareAndSwapWithTTL(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	var swapped bool
+	err := s.breaker.do(ctx, func(ctx context.Context) error {
+		var err error
+		swapped, err = s.store.CompareAndSwapWithTTL(ctx, key, old, new, ttl)
+		return err
+	})
+	return swapped, err
+}
+
+type breakerAtomicStore struct {
+	breakerStore
+	atomic GCRAStoreAtomicCtx
+}
+
+func (s breakerAtomicStore) AdvanceWithTime(ctx context.Context, key string, increment, allowance time.Duration) (int64, time.Time, bool, error) {
+	var value int64
+	var now time.Time
+	var updated bool
+	err := s.breaker.do(ctx, func(ctx context.Context) error {
+		var err error
+		value, now, updated, err = s.atomic.AdvanceWithTime(ctx, key, increment, allowance)
+		return err
+	})
+	return value, now, updated, err
+}
+
+type breakerAdmin struct {
+	breaker *CircuitBreaker
+	admin   StoreAdminCtx
+}
+
+func (s breakerAdmin) Delete(ctx context.Context, key string) error {
+	return s.breaker.do(ctx, func(ctx context.Context) error {
+		return s.admin.Delete(ctx, key)
+	})
+}
+
+func (s breakerAdmin) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := s.breaker.do(ctx, func(ctx context.Context) error {
+		var err error
+		keys, err = s.admin.Keys(ctx, prefix)
+		return err
+	})
+	return keys, err
+}
+
+type breakerAdminStore struct {
+	breakerStore
+	breakerAdmin
+}
+
+type breakerAtomicAdminStore struct {
+	breakerAtomicStore
+	breakerAdmin
+}
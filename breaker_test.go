@@ -0,0 +1,152 @@
+package throttled_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled/v2"
+	"github.com/throttled/throttled/v2/store/memstore"
+)
+
+// flakyStore is a GCRAStoreCtx that fails or stalls on demand.
+type flakyStore struct {
+	throttled.GCRAStoreCtx
+
+	fail  bool
+	delay time.Duration
+	calls int32
+}
+
+func (fs *flakyStore) GetWithTime(ctx context.Context, key string) (int64, time.Time, error) {
+	atomic.AddInt32(&fs.calls, 1)
+	time.Sleep(fs.delay)
+	if fs.fail {
+		return 0, time.Time{}, errors.New("flakyStore error")
+	}
+	return fs.GCRAStoreCtx.GetWithTime(ctx, key)
+}
+
+func newFlakyStore(t *testing.T) *flakyStore {
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &flakyStore{GCRAStoreCtx: mst}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	var changes []string
+	breaker, err := throttled.NewCircuitBreaker(throttled.CircuitBreakerConfig{
+		MaxFailures:  2,
+		Timeout:      20 * time.Millisecond,
+		OpenDuration: 50 * time.Millisecond,
+		OnStateChange: func(from, to throttled.CircuitState) {
+			changes = append(changes, from.String()+"->"+to.String())
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := newFlakyStore(t)
+	if _, ok := breaker.WrapStore(&atomicTestStore{testStore: &testStore{store: fs.GCRAStoreCtx}}).(throttled.GCRAStoreAtomicCtx); !ok {
+		t.Error("expected the wrapped store to support atomic updates like the store")
+	}
+	if _, ok := breaker.WrapStore(fs.GCRAStoreCtx).(throttled.StoreAdminCtx); !ok {
+		t.Error("expected the wrapped store to support administration like memstore")
+	}
+	st := breaker.WrapStore(fs)
+	if _, ok := st.(throttled.GCRAStoreAtomicCtx); ok {
+		t.Error("expected the wrapped store not to support atomic updates")
+	}
+
+	get := func() error {
+		_, _, err := st.GetWithTime(ctx, "foo")
+		return err
+	}
+
+	// A success resets the count of consecutive failures
+	fs.fail = true
+	get()
+	fs.fail = false
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+	fs.fail = true
+	get()
+	if have := breaker.State(); have != throttled.CircuitClosed {
+		t.Errorf("expected the circuit to be closed but it is %s", have)
+	}
+
+	// Slow calls count as failures
+	fs.fail, fs.delay = false, 30*time.Millisecond
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+	if have := breaker.State(); have != throttled.CircuitOpen {
+		t.Fatalf("expected the circuit to be open but it is %s", have)
+	}
+
+	fs.delay = 0
+	calls := atomic.LoadInt32(&fs.calls)
+	if err := get(); err != throttled.ErrCircuitOpen {
+		t.Errorf("expected ErrCircuitOpen but got %v", err)
+	}
+	if atomic.LoadInt32(&fs.calls) != calls {
+		t.Error("expected the store not to be called while the circuit is open")
+	}
+
+	// A failed probe opens the circuit again
+	time.Sleep(60 * time.Millisecond)
+	fs.fail = true
+	get()
+	if err := get(); err != throttled.ErrCircuitOpen {
+		t.Errorf("expected ErrCircuitOpen but got %v", err)
+	}
+
+	// A successful probe closes it
+	time.Sleep(60 * time.Millisecond)
+	fs.fail = false
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+	if have := breaker.State(); have != throttled.CircuitClosed {
+		t.Errorf("expected the circuit to be closed but it is %s", have)
+	}
+
+	want := []string{"closed->open", "open->half-open", "half-open->open", "open->half-open", "half-open->closed"}
+	if len(changes) != len(want) {
+		t.Fatalf("expected state changes %v but got %v", want, changes)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("expected state changes %v but got %v", want, changes)
+			break
+		}
+	}
+}
+
+func TestCircuitBreakerCancelled(t *testing.T) {
+	breaker, err := throttled.NewCircuitBreaker(throttled.CircuitBreakerConfig{MaxFailures: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := newFlakyStore(t)
+	fs.fail = true
+	st := breaker.WrapStore(fs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	st.GetWithTime(ctx, "foo")
+	if have := breaker.State(); have != throttled.CircuitClosed {
+		t.Errorf("expected cancelled calls not to open the circuit but it is %s", have)
+	}
+
+	if _, err := throttled.NewCircuitBreaker(throttled.CircuitBreakerConfig{Timeout: -1}); err == nil {
+		t.Error("expected an error for a negative timeout")
+	}
+}
@@ -0,0 +1,165 @@
+package throttled
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// ClientIP determines the IP address of the client that made a request
+// from its RemoteAddr and, if the request was forwarded by trusted
+// proxies, from the addresses they reported in a header.
+//
+// The addresses in the header are examined starting with the one added
+// by the proxy closest to the server, which is the peer that connected
+// to it. Each address is accepted as long as the proxy that reported it
+// is trusted, and the last accepted address is the client IP. Addresses
+// that untrusted clients put into the header are therefore ignored.
+type ClientIP struct {
+	// Header is the header in which proxies report the address they
+	// received a request from. It must be one of "X-Forwarded-For",
+	// "X-Real-IP" or "Forwarded" as specified by RFC 7239. If it is
+	// empty, the client IP is the address of the peer.
+	Header string
+
+	// TrustedProxies are the networks whose proxies are trusted to
+	// report addresses in the header. ParseCIDRs can be used to create
+	// them. If it is empty, proxies are trusted based on TrustedHops
+	// alone.
+	TrustedProxies []*net.IPNet
+
+	// TrustedHops is the maximum number of proxies in front of the
+	// server, including the peer, that are trusted to report addresses
+	// in the header. If it is zero, proxies are trusted based on
+	// TrustedProxies alone. If neither is set, the header is ignored.
+	TrustedHops int
+}
+
+// IP returns the IP address of the client that made the request, or nil
+// if it can't be determined.
+func (c *ClientIP) IP(r *http.Request) net.IP {
+	ip := parseAddr(r.RemoteAddr)
+	if ip == nil || c == nil || c.Header == "" || len(c.TrustedProxies) == 0 && c.TrustedHops <= 0 {
+		return ip
+	}
+
+	reported := c.reported(r.Header)
+	for hops := 1; len(reported) > 0; hops++ {
+		if !c.trusted(ip, hops) {
+			break
+		}
+		next := parseAddr(reported[len(reported)-1])
+		if next == nil {
+			// The proxy reported an address that can't be used, such as
+			// an obfuscated one
+			break
+		}
+		ip = next
+		reported = reported[:len(reported)-1]
+	}
+	return ip
+}
+
+// trusted reports whether the proxy with the given address, which is
+// the given number of hops away from the server, is trusted.
+func (c *ClientIP) trusted(ip net.IP, hops int) bool {
+	if c.TrustedHops > 0 && hops > c.TrustedHops {
+		return false
+	}
+	if len(c.TrustedProxies) == 0 {
+		return true
+	}
+	return containsIP(c.TrustedProxies, ip)
+}
+
+// reported returns the addresses reported by proxies in the header in
+// the order they were added.
+func (c *ClientIP) reported(h http.Header) []string {
+	values := h[textproto.CanonicalMIMEHeaderKey(c.Header)]
+
+	var addrs []string
+	switch strings.ToLower(c.Header) {
+	case "x-forwarded-for":
+		for _, v := range values {
+			for _, addr := range strings.Split(v, ",") {
+				addrs = append(addrs, strings.TrimSpace(addr))
+			}
+		}
+	case "x-real-ip":
+		if len(values) > 0 {
+			addrs = append(addrs, strings.TrimSpace(values[len(values)-1]))
+		}
+	case "forwarded":
+		for _, v := range values {
+			for _, element := range strings.Split(v, ",") {
+				addrs = append(addrs, forwardedFor(element))
+			}
+		}
+	}
+	return addrs
+}
+
+// forwardedFor returns the value of the for parameter of an element of
+// a Forwarded header, or an empty string if it has none.
+func forwardedFor(element string) string {
+	for _, pair := range strings.Split(element, ";") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+			return strings.Trim(pair[4:], `"`)
+		}
+	}
+	return ""
+}
+
+// parseAddr parses an IP address that may be followed by a port and
+// enclosed in brackets, as in RemoteAddr and proxy headers.
+func parseAddr(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if i := strings.IndexByte(addr, '%'); i != -1 {
+		// Zones of link-local IPv6 addresses don't identify clients
+		addr = addr[:i]
+	}
+	return net.ParseIP(addr)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDRs parses a list of networks in CIDR notation, such as
+// "10.0.0.0/8" or "fd00::/8". Single IP addresses are also accepted and
+// parsed as networks containing only that address.
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
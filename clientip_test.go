@@ -0,0 +1,119 @@
+package throttled_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/throttled/throttled/v2"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := throttled.ParseCIDRs("10.0.0.0/8", "fd00::/8", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		c          *throttled.ClientIP
+		remoteAddr string
+		header     http.Header
+		ip         string
+	}{
+		0: {nil, "1.2.3.4:1234", nil, "1.2.3.4"},
+		1: {&throttled.ClientIP{}, "[2001:db8::1]:1234", nil, "2001:db8::1"},
+		2: {&throttled.ClientIP{}, "garbage", nil, "<nil>"},
+		// Headers are ignored without trusted proxies
+		3: {
+			&throttled.ClientIP{Header: "X-Forwarded-For"},
+			"10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"1.2.3.4"}},
+			"10.0.0.1",
+		},
+		// Headers from untrusted peers are ignored
+		4: {
+			&throttled.ClientIP{Header: "X-Forwarded-For", TrustedProxies: proxies},
+			"5.6.7.8:1234",
+			http.Header{"X-Forwarded-For": {"1.2.3.4"}},
+			"5.6.7.8",
+		},
+		// Addresses spoofed by the client are ignored
+		5: {
+			&throttled.ClientIP{Header: "X-Forwarded-For", TrustedProxies: proxies},
+			"10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"6.6.6.6, 1.2.3.4", "10.0.0.2"}},
+			"1.2.3.4",
+		},
+		6: {
+			&throttled.ClientIP{Header: "X-Forwarded-For", TrustedProxies: proxies},
+			"192.0.2.1:1234",
+			http.Header{"X-Forwarded-For": {"10.0.0.2,10.0.0.3"}},
+			"10.0.0.2",
+		},
+		7: {
+			&throttled.ClientIP{Header: "X-Forwarded-For", TrustedHops: 2},
+			"5.6.7.8:1234",
+			http.Header{"X-Forwarded-For": {"6.6.6.6, 1.2.3.4, 9.9.9.9"}},
+			"1.2.3.4",
+		},
+		8: {
+			&throttled.ClientIP{Header: "X-Forwarded-For", TrustedProxies: proxies, TrustedHops: 1},
+			"10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"1.2.3.4, 10.0.0.2"}},
+			"10.0.0.2",
+		},
+		9: {
+			&throttled.ClientIP{Header: "X-Forwarded-For", TrustedProxies: proxies},
+			"10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"1.2.3.4, not-an-ip"}},
+			"10.0.0.1",
+		},
+		10: {
+			&throttled.ClientIP{Header: "X-Real-IP", TrustedProxies: proxies},
+			"[fd00::1]:1234",
+			http.Header{"X-Real-Ip": {"2001:db8::2"}},
+			"2001:db8::2",
+		},
+		11: {
+			&throttled.ClientIP{Header: "Forwarded", TrustedProxies: proxies},
+			"10.0.0.1:1234",
+			http.Header{"Forwarded": {`for=6.6.6.6, for="[2001:db8::3]:4711";proto=https, by=10.0.0.1;For=10.0.0.2`}},
+			"2001:db8::3",
+		},
+		12: {
+			&throttled.ClientIP{Header: "Forwarded", TrustedProxies: proxies},
+			"10.0.0.1:1234",
+			http.Header{"Forwarded": {"for=1.2.3.4, for=_hidden"}},
+			"10.0.0.1",
+		},
+		13: {
+			&throttled.ClientIP{Header: "X-Forwarded-For", TrustedProxies: proxies},
+			"10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"10.0.0.2"}},
+			"10.0.0.2",
+		},
+	}
+	for i, c := range cases {
+		r := &http.Request{RemoteAddr: c.remoteAddr, Header: c.header}
+		if have := c.c.IP(r).String(); have != c.ip {
+			t.Errorf("%d: expected %s but got %s", i, c.ip, have)
+		}
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := throttled.ParseCIDRs("10.0.0.0/8", "192.0.2.1", "2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::1/128"} {
+		if have := nets[i].String(); have != want {
+			t.Errorf("expected %s but got %s", want, have)
+		}
+	}
+
+	for _, cidr := range []string{"10.0.0.0/33", "not-an-ip"} {
+		if _, err := throttled.ParseCIDRs(cidr); err == nil {
+			t.Errorf("expected %s to be invalid", cidr)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package throttled
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrLeaseExpired is returned when extending a Lease that has already
+// expired or been released.
+var ErrLeaseExpired = errors.New("lease has expired")
+
+// A ConcurrencyLimiterCtx manages limiting the number of actions in
+// progress at the same time by key, such as the number of simultaneous
+// exports per tenant.
+type ConcurrencyLimiterCtx interface {
+	// AcquireCtx checks whether a particular key already has the
+	// maximum number of actions in progress. If it doesn't, one of the
+	// key's slots is taken and held until the returned Lease is
+	// released. If the limit has been reached, it returns true and a
+	// nil Lease.
+	AcquireCtx(ctx context.Context, key string) (bool, Lease, error)
+}
+
+// A Lease is a slot of a ConcurrencyLimiterCtx held by an action in
+// progress.
+type Lease interface {
+	// Release gives the slot back once the action has completed.
+	Release(ctx context.Context) error
+
+	// Extend renews the lease of an action that is still in progress
+	// so that it doesn't expire. It returns ErrLeaseExpired if the
+	// lease has already expired.
+	Extend(ctx context.Context) error
+}
+
+// LeaseConcurrencyLimiterCtx is a ConcurrencyLimiterCtx that keeps
+// track of the slots in use as leases in a ConcurrencyStoreCtx. Leases
+// expire after a fixed time so that slots held by processes that
+// crashed before releasing them are eventually reclaimed.
+type LeaseConcurrencyLimiterCtx struct {
+	limit    int
+	leaseTTL time.Duration
+	store    ConcurrencyStoreCtx
+}
+
+// NewConcurrencyLimiterCtx creates a LeaseConcurrencyLimiterCtx that
+// permits up to limit actions in progress per key. Slots that are not
+// released are reclaimed after leaseTTL, which should be longer than
+// the longest expected action unless the leases of longer actions are
+// extended; an action outliving its lease no longer counts against the
+// limit.
+func NewConcurrencyLimiterCtx(st ConcurrencyStoreCtx, limit int, leaseTTL time.Duration) (*LeaseConcurrencyLimiterCtx, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid limit %d; limit must be greater than zero", limit)
+	}
+	if leaseTTL <= 0 {
+		return nil, fmt.Errorf("invalid lease TTL %s; lease TTL must be greater than zero", leaseTTL)
+	}
+
+	return &LeaseConcurrencyLimiterCtx{
+		limit:    limit,
+		leaseTTL: leaseTTL,
+		store:    st,
+	}, nil
+}
+
+// AcquireCtx checks whether a particular key already has the maximum
+// number of actions in progress. If it doesn't, one of the key's slots
+// is taken and held until the returned Lease is released or expires.
+// If the limit has been reached, it returns true and a nil Lease.
+func (c *LeaseConcurrencyLimiterCtx) AcquireCtx(ctx context.Context, key string) (bool, Lease, error) {
+	id, err := newLeaseID()
+	if err != nil {
+		return false, nil, err
+	}
+
+	acquired, _, err := c.store.AcquireLease(ctx, key, id, c.limit, c.leaseTTL)
+	if err != nil {
+		return false, nil, err
+	}
+	if !acquired {
+		return true, nil, nil
+	}
+
+	return false, &storeLease{store: c.store, key: key, id: id, ttl: c.leaseTTL}, nil
+}
+
+type storeLease struct {
+	store   ConcurrencyStoreCtx
+	key, id string
+	ttl     time.Duration
+}
+
+func (l *storeLease) Release(ctx context.Context) error {
+	return l.store.ReleaseLease(ctx, l.key, l.id)
+}
+
+// Extend sets the lease to expire after the lease TTL of the limiter.
+func (l *storeLease) Extend(ctx context.Context) error {
+	held, err := l.store.ExtendLease(ctx, l.key, l.id, l.ttl)
+	if err != nil {
+		return err
+	}
+	if !held {
+		return ErrLeaseExpired
+	}
+	return nil
+}
+
+// newLeaseID returns a random identifier that is unique among the
+// leases of all processes sharing a store.
+func newLeaseID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,181 @@
+package throttled_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled/v2"
+	"github.com/throttled/throttled/v2/store/memstore"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	st, err := memstore.NewShardedCtx(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := time.Unix(1000, 0)
+	st.SetTimeNow(func() time.Time { return clock })
+
+	cl, err := throttled.NewConcurrencyLimiterCtx(st, 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	acquire := func(key string, want bool) throttled.Lease {
+		t.Helper()
+		limited, lease, err := cl.AcquireCtx(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limited == want {
+			t.Fatalf("expected acquiring %s to be %t but got %t", key, want, !limited)
+		}
+		return lease
+	}
+
+	first := acquire("foo", true)
+	acquire("foo", true)
+	acquire("foo", false)
+	acquire("bar", true)
+
+	if err := first.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	acquire("foo", true)
+	acquire("foo", false)
+
+	// Leases that are never released expire
+	clock = clock.Add(time.Minute)
+	acquire("foo", true)
+}
+
+func TestConcurrencyLimiterInvalid(t *testing.T) {
+	st, err := memstore.NewShardedCtx(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := throttled.NewConcurrencyLimiterCtx(st, 0, time.Minute); err == nil {
+		t.Error("expected creating a limiter with a zero limit to fail")
+	}
+	if _, err := throttled.NewConcurrencyLimiterCtx(st, 1, 0); err == nil {
+		t.Error("expected creating a limiter with a zero lease TTL to fail")
+	}
+}
+
+func TestHTTPConcurrencyLimiter(t *testing.T) {
+	st, err := memstore.NewShardedCtx(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := throttled.NewConcurrencyLimiterCtx(st, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := throttled.HTTPConcurrencyLimiterCtx{
+		ConcurrencyLimiter: cl,
+		VaryBy:             &pathGetter{},
+	}
+
+	var once sync.Once
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	handler := limiter.Limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "block" {
+			once.Do(func() { close(started) })
+			<-unblock
+		}
+		w.WriteHeader(200)
+	}))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runHTTPTestCases(t, handler, []httpTestCase{{"block", 200, nil}})
+	}()
+	<-started
+
+	// The slot for the blocked path is taken while other paths are free
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"block", 429, nil},
+		{"other", 200, nil},
+		{"other", 200, nil},
+	})
+
+	// The slot is released when the handler returns
+	close(unblock)
+	wg.Wait()
+	runHTTPTestCases(t, handler, []httpTestCase{{"block", 200, nil}})
+}
+
+// extendingStore signals each extension of a lease.
+type extendingStore struct {
+	*memstore.ShardedStore
+	extended chan struct{}
+}
+
+func (s *extendingStore) ExtendLease(ctx context.Context, key, id string, ttl time.Duration) (bool, error) {
+	held, err := s.ShardedStore.ExtendLease(ctx, key, id, ttl)
+	select {
+	case s.extended <- struct{}{}:
+	default:
+	}
+	return held, err
+}
+
+func TestHTTPConcurrencyLimiterRenew(t *testing.T) {
+	mst, err := memstore.NewShardedCtx(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clock int64 = 1000
+	mst.SetTimeNow(func() time.Time { return time.Unix(atomic.LoadInt64(&clock), 0) })
+	st := &extendingStore{ShardedStore: mst, extended: make(chan struct{})}
+
+	cl, err := throttled.NewConcurrencyLimiterCtx(st, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := throttled.HTTPConcurrencyLimiterCtx{
+		ConcurrencyLimiter: cl,
+		RenewInterval:      time.Millisecond,
+	}
+
+	var once sync.Once
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	handler := limiter.Limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "block" {
+			once.Do(func() { close(started) })
+			<-unblock
+		}
+		w.WriteHeader(200)
+	}))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runHTTPTestCases(t, handler, []httpTestCase{{"block", 200, nil}})
+	}()
+	<-started
+
+	// The lease is extended while the request is in progress, so it
+	// still holds the slot after the lease TTL
+	atomic.AddInt64(&clock, 50)
+	<-st.extended
+	<-st.extended
+	atomic.AddInt64(&clock, 50)
+	runHTTPTestCases(t, handler, []httpTestCase{{"other", 429, nil}})
+
+	close(unblock)
+	wg.Wait()
+	runHTTPTestCases(t, handler, []httpTestCase{{"other", 200, nil}})
+}
@@ -0,0 +1,71 @@
+package throttled
+
+import "context"
+
+// RateLimitInfo describes how HTTPRateLimiterCtx rate limited a request.
+// It is stored in the context of the request passed on to the wrapped
+// handler or the DeniedHandler.
+type RateLimitInfo struct {
+	// Policy is the Name of the HTTPRateLimiterCtx, which tells which
+	// policy made the decision if a PolicyMux is used.
+	Policy string
+
+	// Key is the key generated for the request by VaryBy.
+	Key string
+
+	// Quota is the quota enforced for the key, or nil if the
+	// RateLimiter doesn't implement QuotaProvider or doesn't know it.
+	Quota *RateQuota
+
+	// Result is the state of the RateLimiter for the key after the
+	// request was rate limited.
+	Result RateLimitResult
+
+	// Limited is whether the request was denied.
+	Limited bool
+
+	// DryRun is whether the request was passed to the handler regardless
+	// of Limited, as the HTTPRateLimiterCtx was in DryRun mode.
+	DryRun bool
+}
+
+type rateLimitInfoKey struct{}
+
+func withRateLimitInfo(ctx context.Context, info RateLimitInfo) context.Context {
+	return context.WithValue(ctx, rateLimitInfoKey{}, info)
+}
+
+// RateLimitInfoFromContext returns the RateLimitInfo stored in the
+// context of a request by HTTPRateLimiterCtx. It returns false if the
+// request wasn't rate limited. If several HTTPRateLimiterCtx are
+// nested, the innermost one takes precedence.
+func RateLimitInfoFromContext(ctx context.Context) (RateLimitInfo, bool) {
+	info, ok := ctx.Value(rateLimitInfoKey{}).(RateLimitInfo)
+	return info, ok
+}
+
+// RateLimitKeyFromContext returns the key under which a request was
+// rate limited by HTTPRateLimiterCtx, if any.
+func RateLimitKeyFromContext(ctx context.Context) (string, bool) {
+	info, ok := RateLimitInfoFromContext(ctx)
+	return info.Key, ok
+}
+
+// RateQuotaFromContext returns the quota enforced for a request by
+// HTTPRateLimiterCtx. It returns false if the request wasn't rate
+// limited or the RateLimiter doesn't implement QuotaProvider or doesn't
+// know the quota.
+func RateQuotaFromContext(ctx context.Context) (RateQuota, bool) {
+	info, ok := RateLimitInfoFromContext(ctx)
+	if !ok || info.Quota == nil {
+		return RateQuota{}, false
+	}
+	return *info.Quota, true
+}
+
+// RateLimitResultFromContext returns the RateLimitResult of a request
+// rate limited by HTTPRateLimiterCtx, if any.
+func RateLimitResultFromContext(ctx context.Context) (RateLimitResult, bool) {
+	info, ok := RateLimitInfoFromContext(ctx)
+	return info.Result, ok
+}
@@ -0,0 +1,89 @@
+package throttled_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled/v2"
+	"github.com/throttled/throttled/v2/store/memstore"
+)
+
+func TestRateLimitInfoFromContext(t *testing.T) {
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 1}
+	rl, err := throttled.NewGCRARateLimiterCtx(&testStore{store: mst, clock: time.Unix(0, 0)}, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var infos []throttled.RateLimitInfo
+	record := func(w http.ResponseWriter, r *http.Request) {
+		info, ok := throttled.RateLimitInfoFromContext(r.Context())
+		if !ok {
+			t.Fatal("expected the info to be available to the handler")
+		}
+		infos = append(infos, info)
+	}
+
+	limiter := throttled.HTTPRateLimiterCtx{
+		RateLimiter:   rl,
+		VaryBy:        &pathGetter{},
+		DeniedHandler: http.HandlerFunc(record),
+	}
+	handler := limiter.RateLimit(http.HandlerFunc(record))
+
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil))
+	}
+
+	for i, want := range []throttled.RateLimitInfo{
+		{Key: "/foo", Quota: &rq, Result: throttled.RateLimitResult{Limit: 2, Remaining: 1, ResetAfter: time.Minute, RetryAfter: -1}},
+		{Key: "/foo", Quota: &rq, Result: throttled.RateLimitResult{Limit: 2, Remaining: 0, ResetAfter: 2 * time.Minute, RetryAfter: -1}},
+		{Key: "/foo", Quota: &rq, Result: throttled.RateLimitResult{Limit: 2, Remaining: 0, ResetAfter: 2 * time.Minute, RetryAfter: time.Minute}, Limited: true},
+	} {
+		have := infos[i]
+		if have.Key != want.Key || have.Result != want.Result || have.Limited != want.Limited {
+			t.Errorf("%d: expected %+v but got %+v", i, want, have)
+		}
+		if have.Quota == nil || *have.Quota != *want.Quota {
+			t.Errorf("%d: expected Quota to be %+v but got %+v", i, *want.Quota, have.Quota)
+		}
+	}
+}
+
+func TestRateLimitInfoAccessors(t *testing.T) {
+	ctx := context.Background()
+	if _, ok := throttled.RateLimitKeyFromContext(ctx); ok {
+		t.Error("expected no key in a context without info")
+	}
+
+	limiter := throttled.HTTPRateLimiterCtx{
+		RateLimiter: &stubLimiter{},
+		VaryBy:      &pathGetter{},
+	}
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = r.Context()
+	}))
+	req, err := http.NewRequest("GET", "ok", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if key, ok := throttled.RateLimitKeyFromContext(ctx); !ok || key != "ok" {
+		t.Errorf("expected the key to be ok but got %q", key)
+	}
+	if result, ok := throttled.RateLimitResultFromContext(ctx); !ok || result.Remaining != 2 {
+		t.Errorf("expected Remaining to be 2 but got %+v", result)
+	}
+	// The stub limiter doesn't report its quota
+	if _, ok := throttled.RateQuotaFromContext(ctx); ok {
+		t.Error("expected no quota for a limiter that doesn't report it")
+	}
+}
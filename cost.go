@@ -0,0 +1,75 @@
+package throttled
+
+import (
+	"math"
+	"net/http"
+	"strings"
+)
+
+// ContentLengthCost returns a Cost function for HTTPRateLimiterCtx that
+// charges one unit per bytesPerUnit bytes of request body, rounded up,
+// so that for example uploads can be limited by size. Requests without
+// a body or whose length is unknown, such as chunked uploads, cost 1.
+// The cost is capped at math.MaxInt32 units, as the Content-Length is
+// chosen by the client.
+func ContentLengthCost(bytesPerUnit int64) func(*http.Request) int {
+	return func(r *http.Request) int {
+		if r.ContentLength <= 0 || bytesPerUnit <= 0 {
+			return 1
+		}
+		units := r.ContentLength/bytesPerUnit + 1
+		if r.ContentLength%bytesPerUnit == 0 {
+			units--
+		}
+		if units > math.MaxInt32 {
+			return math.MaxInt32
+		}
+		return int(units)
+	}
+}
+
+// CostWeight assigns a cost to the requests matching a method and path.
+type CostWeight struct {
+	// Method is the HTTP method of matching requests. If it is empty,
+	// requests with any method match.
+	Method string
+
+	// Path is the URL path of matching requests. A path ending in a
+	// slash, such as "/export/", matches all paths it is a prefix of,
+	// like the patterns of http.ServeMux. If it is empty, requests with
+	// any path match.
+	Path string
+
+	// Cost is the quantity counted for a matching request.
+	Cost int
+}
+
+func (cw CostWeight) matches(r *http.Request) bool {
+	if cw.Method != "" && cw.Method != r.Method {
+		return false
+	}
+	if cw.Path == "" || cw.Path == r.URL.Path {
+		return true
+	}
+	return strings.HasSuffix(cw.Path, "/") && strings.HasPrefix(r.URL.Path, cw.Path)
+}
+
+// WeightedCost returns a Cost function for HTTPRateLimiterCtx that
+// charges the cost of the first of the weights matching a request, or
+// defaultCost if none of them do. For example:
+//
+//	WeightedCost(1,
+//		CostWeight{Method: "GET", Path: "/search", Cost: 5},
+//		CostWeight{Path: "/export/", Cost: 20},
+//		CostWeight{Method: "POST", Cost: 2},
+//	)
+func WeightedCost(defaultCost int, weights ...CostWeight) func(*http.Request) int {
+	return func(r *http.Request) int {
+		for _, w := range weights {
+			if w.matches(r) {
+				return w.Cost
+			}
+		}
+		return defaultCost
+	}
+}
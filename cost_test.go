@@ -0,0 +1,200 @@
+package throttled_test
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled/v2"
+	"github.com/throttled/throttled/v2/store/memstore"
+)
+
+func TestHTTPRateLimiterCost(t *testing.T) {
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 9}
+	rl, err := throttled.NewGCRARateLimiterCtx(&testStore{store: mst, clock: time.Unix(0, 0)}, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := throttled.HTTPRateLimiterCtx{
+		RateLimiter: rl,
+		Cost: throttled.WeightedCost(1,
+			throttled.CostWeight{Path: "expensive", Cost: 6},
+			throttled.CostWeight{Path: "free", Cost: 0},
+		),
+	}
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"cheap", 200, map[string]string{"X-Ratelimit-Remaining": "9"}},
+		{"expensive", 200, map[string]string{"X-Ratelimit-Remaining": "3"}},
+		{"expensive", 429, map[string]string{"X-Ratelimit-Remaining": "3"}},
+		{"free", 200, map[string]string{"X-Ratelimit-Remaining": "3"}},
+		{"cheap", 200, map[string]string{"X-Ratelimit-Remaining": "2"}},
+	})
+}
+
+func TestContentLengthCost(t *testing.T) {
+	cost := throttled.ContentLengthCost(1024)
+	for _, c := range []struct {
+		length int64
+		want   int
+	}{
+		{-1, 1},
+		{0, 1},
+		{1, 1},
+		{1024, 1},
+		{1025, 2},
+		{10 * 1024, 10},
+		{math.MaxInt64, math.MaxInt32},
+	} {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.ContentLength = c.length
+		if have := cost(r); have != c.want {
+			t.Errorf("expected a length of %d to cost %d but got %d", c.length, c.want, have)
+		}
+	}
+}
+
+func TestHTTPRateLimiterHugeContentLength(t *testing.T) {
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &testStore{store: mst, clock: time.Unix(0, 0)}
+	rq := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 2}
+	rl, err := throttled.NewGCRARateLimiterCtx(st, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := throttled.HTTPRateLimiterCtx{
+		RateLimiter: rl,
+		VaryBy:      &throttled.VaryBy{Method: true},
+		Cost:        throttled.ContentLengthCost(1024),
+	}
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	tat := func() int64 {
+		value, _, err := mst.GetWithTime(context.Background(), "POST\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+
+	for i, c := range []struct {
+		length int64
+		code   int
+	}{
+		{1024, 200},
+		{1024, 200},
+		{1024, 200},
+		{1024, 429},
+		{1 << 62, 429},
+		{math.MaxInt64, 429},
+		{1024, 429},
+	} {
+		before := tat()
+		r := httptest.NewRequest("POST", "/", nil)
+		r.ContentLength = c.length
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		if rr.Code != c.code {
+			t.Errorf("%d: expected %d but got %d", i, c.code, rr.Code)
+		}
+		if c.code == 429 && tat() != before {
+			t.Errorf("%d: expected a limited request to keep the TAT at %d but got %d", i, before, tat())
+		}
+	}
+}
+
+func TestWeightedCost(t *testing.T) {
+	cost := throttled.WeightedCost(1,
+		throttled.CostWeight{Method: "GET", Path: "/search", Cost: 5},
+		throttled.CostWeight{Path: "/export/", Cost: 20},
+		throttled.CostWeight{Method: "POST", Cost: 2},
+	)
+	for _, c := range []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", "/search", 5},
+		{"GET", "/search/more", 1},
+		{"POST", "/search", 2},
+		{"GET", "/export/users", 20},
+		{"POST", "/export/", 20},
+		{"GET", "/export", 1},
+		{"DELETE", "/", 1},
+	} {
+		if have := cost(httptest.NewRequest(c.method, c.path, nil)); have != c.want {
+			t.Errorf("expected %s %s to cost %d but got %d", c.method, c.path, c.want, have)
+		}
+	}
+}
+
+func TestGraphQLCost(t *testing.T) {
+	cost := throttled.GraphQLCost(1024, 100)
+	for i, c := range []struct {
+		query string
+		want  int
+	}{
+		0: {`{ users(first: 10) { name friends(first: 5) { name } } }`, 71},
+		1: {`query Q($n: Int = 3) { viewer { login } }`, 2},
+		2: {`{ a: user(id: "}{") { id, ...F, ... on Admin @include(if: true) { level } } }
+			fragment F on User { email }`, 4},
+		3: {`{ search(filter: {first: 2}, last: 4) { id } # comment { x }
+			}`, 5},
+		4: {`{ node(id: """block "string" { """) { id } }`, 2},
+		5: {`{ unbalanced { id }`, 100},
+		6: {``, 100},
+	} {
+		r := httptest.NewRequest("GET", "/graphql?query="+url.QueryEscape(c.query), nil)
+		if have := cost(r); have != c.want {
+			t.Errorf("%d: expected the query to cost %d but got %d", i, c.want, have)
+		}
+	}
+}
+
+func TestGraphQLCostBody(t *testing.T) {
+	cost := throttled.GraphQLCost(64, 100)
+	for i, c := range []struct {
+		contentType, body string
+		want              int
+	}{
+		0: {"application/json", `{"query": "{ a b }"}`, 2},
+		1: {"application/json", `[{"query": "{ a }"}, {"query": "{ b c }"}]`, 3},
+		2: {"application/graphql", `{ a b c }`, 3},
+		3: {"application/json", `{"query": "{ a }", "padding": "` + strings.Repeat("x", 64) + `"}`, 100},
+		4: {"application/json", `not json`, 100},
+	} {
+		r := httptest.NewRequest("POST", "/graphql", strings.NewReader(c.body))
+		r.Header.Set("Content-Type", c.contentType)
+		if have := cost(r); have != c.want {
+			t.Errorf("%d: expected the request to cost %d but got %d", i, c.want, have)
+		}
+
+		// The handler can still read the whole body
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != c.body {
+			t.Errorf("%d: expected the body to be restored but got %s", i, body)
+		}
+	}
+}
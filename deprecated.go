@@ -10,7 +10,7 @@ import (
 //
 // Deprecated: Use Rate and RateLimiter instead.
 func (q Rate) Quota() (int, time.Duration) {
-	return q.count, q.period * time.Duration(q.count)
+	return q.count, q.window
 }
 
 // Q represents a custom quota.
@@ -65,7 +65,7 @@ func RateLimit(q Quota, vary *VaryBy, store GCRAStore) *Throttler {
 		period = time.Second
 	}
 
-	rate := Rate{period: period / time.Duration(count)}
+	rate := PerDuration(count, period)
 	limiter, err := NewGCRARateLimiterCtx(WrapStoreWithContext(store), RateQuota{rate, count - 1})
 
 	// This panic in unavoidable because the original interface does
@@ -170,9 +170,23 @@ func (g *GCRARateLimiterCtx) RateLimit(key string, quantity int) (bool, RateLimi
 
 // WrapStoreWithContext can be used to use GCRAStore in a place where a GCRAStoreCtx is required.
 func WrapStoreWithContext(store GCRAStore) GCRAStoreCtx {
-	return gcraStoreCtxAdapter{
+	adapter := gcraStoreCtxAdapter{
 		gcraStore: store,
 	}
+	atomic, isAtomic := store.(gcraStoreAtomic)
+	admin, isAdmin := store.(storeAdmin)
+	switch {
+	case isAtomic && isAdmin:
+		return gcraStoreAtomicAdminCtxAdapter{
+			gcraStoreAtomicCtxAdapter{adapter, atomic},
+			storeAdminCtxAdapter{admin},
+		}
+	case isAtomic:
+		return gcraStoreAtomicCtxAdapter{adapter, atomic}
+	case isAdmin:
+		return gcraStoreAdminCtxAdapter{adapter, storeAdminCtxAdapter{admin}}
+	}
+	return adapter
 }
 
 // WrapRateLimiterWithContext can be used to use RateLimiter in a place where a RateLimiterCtx is required.
@@ -207,3 +221,39 @@ type rateLimiterCtxAdapter struct {
 func (r rateLimiterCtxAdapter) RateLimitCtx(_ context.Context, key string, quantity int) (bool, RateLimitResult, error) {
 	return r.rateLimiter.RateLimit(key, quantity)
 }
+
+// gcraStoreAtomicCtxAdapter is an adapter that is used to use a GCRAStore
+// that supports atomic updates where a GCRAStoreAtomicCtx is required.
+type gcraStoreAtomicCtxAdapter struct {
+	gcraStoreCtxAdapter
+	atomic gcraStoreAtomic
+}
+
+func (g gcraStoreAtomicCtxAdapter) AdvanceWithTime(_ context.Context, key string, increment, allowance time.Duration) (int64, time.Time, bool, error) {
+	return g.atomic.AdvanceWithTime(key, increment, allowance)
+}
+
+// storeAdminCtxAdapter is an adapter that is used to use a GCRAStore
+// that supports administrative operations where a StoreAdminCtx is
+// required.
+type storeAdminCtxAdapter struct {
+	admin storeAdmin
+}
+
+func (s storeAdminCtxAdapter) Delete(_ context.Context, key string) error {
+	return s.admin.Delete(key)
+}
+
+func (s storeAdminCtxAdapter) Keys(_ context.Context, prefix string) ([]string, error) {
+	return s.admin.Keys(prefix)
+}
+
+type gcraStoreAdminCtxAdapter struct {
+	gcraStoreCtxAdapter
+	storeAdminCtxAdapter
+}
+
+type gcraStoreAtomicAdminCtxAdapter struct {
+	gcraStoreAtomicCtxAdapter
+	storeAdminCtxAdapter
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/throttled/throttled/v2"
 	"github.com/throttled/throttled/v2/store"
@@ -57,3 +58,11 @@ func TestDeprecatedUsage(t *testing.T) {
 		}
 	}
 }
+
+func TestDeprecatedQuota(t *testing.T) {
+	// The window isn't rounded down to a whole number of periods
+	count, window := throttled.PerHour(7).Quota()
+	if count != 7 || window != time.Hour {
+		t.Errorf("expected a quota of 7 per %s but got %d per %s", time.Hour, count, window)
+	}
+}
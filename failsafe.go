@@ -0,0 +1,134 @@
+package throttled
+
+import (
+	"context"
+	"errors"
+)
+
+// FailurePolicy determines how a FailSafeRateLimiterCtx handles requests
+// that its limiter fails to rate limit.
+type FailurePolicy int
+
+const (
+	// FailOpen permits the requests.
+	FailOpen FailurePolicy = iota + 1
+
+	// FailClosed limits the requests.
+	FailClosed
+
+	// FailFallback rate limits the requests with the fallback limiter,
+	// usually one using a local store such as memstore, so that limits
+	// are still enforced per instance while a shared store is
+	// unavailable.
+	FailFallback
+)
+
+// FailSafeRateLimiterCtx is a RateLimiterCtx that handles the errors of
+// another RateLimiterCtx according to a FailurePolicy instead of
+// returning them, so that an unavailable store doesn't cause every
+// request to fail. Combined with a CircuitBreaker around the store,
+// requests are handled without waiting for the store while it is down:
+//
+//	breaker, err := throttled.NewCircuitBreaker(throttled.CircuitBreakerConfig{
+//		Timeout: 50 * time.Millisecond,
+//	})
+//	limiter, err := throttled.NewGCRARateLimiterCtx(breaker.WrapStore(redisStore), quota)
+//	fallback, err := throttled.NewGCRARateLimiterCtx(memStore, quota)
+//	rateLimiter, err := throttled.NewFailSafeRateLimiterCtx(limiter, throttled.FailFallback, fallback)
+type FailSafeRateLimiterCtx struct {
+	limiter  RateLimiterCtx
+	policy   FailurePolicy
+	fallback RateLimiterCtx
+	onError  func(ctx context.Context, key string, err error)
+}
+
+// NewFailSafeRateLimiterCtx creates a FailSafeRateLimiterCtx that handles
+// the errors of limiter according to policy. A fallback limiter must be
+// given for FailFallback and only then.
+func NewFailSafeRateLimiterCtx(limiter RateLimiterCtx, policy FailurePolicy, fallback RateLimiterCtx) (*FailSafeRateLimiterCtx, error) {
+	if limiter == nil {
+		return nil, errors.New("a RateLimiterCtx is required")
+	}
+	switch policy {
+	case FailOpen, FailClosed:
+		if fallback != nil {
+			return nil, errors.New("a fallback RateLimiterCtx is only used by FailFallback")
+		}
+	case FailFallback:
+		if fallback == nil {
+			return nil, errors.New("FailFallback requires a fallback RateLimiterCtx")
+		}
+	default:
+		return nil, errors.New("invalid FailurePolicy")
+	}
+	return &FailSafeRateLimiterCtx{limiter: limiter, policy: policy, fallback: fallback}, nil
+}
+
+// SetOnError sets a function that is called with each error handled by the
+// failure policy, for example to log it. It must be called before
+// the limiter is used.
+func (f *FailSafeRateLimiterCtx) SetOnError(onError func(ctx context.Context, key string, err error)) {
+	f.onError = onError
+}
+
+// RateLimitCtx rate limits the request with the limiter and applies the
+// failure policy if it returns an error. Requests permitted or limited
+// by the policy itself have a RateLimitResult with all fields set to -1.
+// Errors of the fallback limiter are returned.
+func (f *FailSafeRateLimiterCtx) RateLimitCtx(ctx context.Context, key string, quantity int) (bool, RateLimitResult, error) {
+	limited, result, err := f.limiter.RateLimitCtx(ctx, key, quantity)
+	if err == nil {
+		return limited, result, nil
+	}
+
+	if f.onError != nil {
+		f.onError(ctx, key, err)
+	}
+
+	unknown := RateLimitResult{Limit: -1, Remaining: -1, ResetAfter: -1, RetryAfter: -1}
+	switch f.policy {
+	case FailOpen:
+		return false, unknown, nil
+	case FailClosed:
+		return true, unknown, nil
+	}
+	return f.fallback.RateLimitCtx(ctx, key, quantity)
+}
+
+// QuotaCtx returns the quota enforced for key by the limiter. With
+// FailFallback, the quota of the fallback limiter is returned instead if
+// the limiter fails to report it or doesn't implement QuotaProvider, and
+// errors of the fallback limiter are returned. Otherwise, it returns
+// ErrQuotaUnknown, so that the quota is left out of the response headers
+// rather than failing the request.
+func (f *FailSafeRateLimiterCtx) QuotaCtx(ctx context.Context, key string) (RateQuota, error) {
+	if qp, ok := f.limiter.(QuotaProvider); ok {
+		if quota, err := qp.QuotaCtx(ctx, key); err == nil {
+			return quota, nil
+		}
+	}
+	if qp, ok := f.fallback.(QuotaProvider); ok && f.policy == FailFallback {
+		return qp.QuotaCtx(ctx, key)
+	}
+	return RateQuota{}, ErrQuotaUnknown
+}
+
+// PeekCtx returns the state of key in the limiter without updating it,
+// with RetryAfter set to the time until quantity would be permitted, or
+// -1 if it would be permitted now or never. With FailFallback, the
+// fallback limiter is peeked at instead if the limiter fails, and its
+// errors are returned. Otherwise, the error of the limiter is returned.
+// Limiters that don't implement Peeker return ErrPeekNotSupported.
+func (f *FailSafeRateLimiterCtx) PeekCtx(ctx context.Context, key string, quantity int) (RateLimitResult, error) {
+	err := ErrPeekNotSupported
+	if p, ok := f.limiter.(Peeker); ok {
+		var result RateLimitResult
+		if result, err = p.PeekCtx(ctx, key, quantity); err == nil {
+			return result, nil
+		}
+	}
+	if p, ok := f.fallback.(Peeker); ok && f.policy == FailFallback {
+		return p.PeekCtx(ctx, key, quantity)
+	}
+	return RateLimitResult{}, err
+}
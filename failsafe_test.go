@@ -0,0 +1,142 @@
+package throttled_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/throttled/throttled/v2"
+)
+
+func TestFailSafeRateLimiter(t *testing.T) {
+	ctx := context.Background()
+
+	for _, c := range []struct {
+		policy   throttled.FailurePolicy
+		fallback throttled.RateLimiterCtx
+		limited  bool
+		limit    int
+	}{
+		{throttled.FailOpen, nil, false, -1},
+		{throttled.FailClosed, nil, true, -1},
+		{throttled.FailFallback, newTestGCRA(t, 4), false, 5},
+	} {
+		rl, err := throttled.NewFailSafeRateLimiterCtx(&stubLimiter{}, c.policy, c.fallback)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var handled error
+		rl.SetOnError(func(_ context.Context, key string, err error) {
+			handled = err
+		})
+
+		limited, result, err := rl.RateLimitCtx(ctx, "error", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limited != c.limited || result.Limit != c.limit {
+			t.Errorf("%d: expected limited %t with limit %d but got %t with %d",
+				c.policy, c.limited, c.limit, limited, result.Limit)
+		}
+		if handled == nil {
+			t.Errorf("%d: expected the error to be passed to OnError", c.policy)
+		}
+
+		// Requests that don't fail are rate limited as usual
+		limited, result, err = rl.RateLimitCtx(ctx, "limit", 1)
+		if err != nil || !limited || result.RetryAfter <= 0 {
+			t.Errorf("%d: expected the limiter's decision but got %t, %+v, %v", c.policy, limited, result, err)
+		}
+	}
+
+	for _, c := range []struct {
+		limiter  throttled.RateLimiterCtx
+		policy   throttled.FailurePolicy
+		fallback throttled.RateLimiterCtx
+	}{
+		{nil, throttled.FailOpen, nil},
+		{&stubLimiter{}, throttled.FailOpen, &stubLimiter{}},
+		{&stubLimiter{}, throttled.FailFallback, nil},
+		{&stubLimiter{}, 0, nil},
+	} {
+		if _, err := throttled.NewFailSafeRateLimiterCtx(c.limiter, c.policy, c.fallback); err == nil {
+			t.Errorf("expected an error for %+v", c)
+		}
+	}
+}
+
+func TestFailSafeRateLimiterQuota(t *testing.T) {
+	ctx := context.Background()
+
+	for i, c := range []struct {
+		limiter  throttled.RateLimiterCtx
+		policy   throttled.FailurePolicy
+		fallback throttled.RateLimiterCtx
+		burst    int
+		err      error
+	}{
+		{newTestGCRA(t, 2), throttled.FailOpen, nil, 2, nil},
+		{newTestGCRA(t, 2), throttled.FailFallback, newTestGCRA(t, 4), 2, nil},
+		{&stubLimiter{}, throttled.FailFallback, newTestGCRA(t, 4), 4, nil},
+		{&stubLimiter{}, throttled.FailClosed, nil, 0, throttled.ErrQuotaUnknown},
+	} {
+		rl, err := throttled.NewFailSafeRateLimiterCtx(c.limiter, c.policy, c.fallback)
+		if err != nil {
+			t.Fatal(err)
+		}
+		quota, err := rl.QuotaCtx(ctx, "foo")
+		if err != c.err || quota.MaxBurst != c.burst {
+			t.Errorf("%d: expected a MaxBurst of %d and error %v but got %d and %v", i, c.burst, c.err, quota.MaxBurst, err)
+		}
+	}
+
+	// A limiter that doesn't know its quota is served without describing it
+	rl, err := throttled.NewFailSafeRateLimiterCtx(&stubLimiter{}, throttled.FailOpen, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := throttled.HTTPRateLimiterCtx{
+		RateLimiter: rl,
+		VaryBy:      &pathGetter{},
+		Headers:     throttled.IETFHeaders{},
+	}
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"ok", 200, map[string]string{"RateLimit": `"default";r=2;t=60`, "RateLimit-Policy": ""}},
+		{"error", 200, map[string]string{"RateLimit": "", "RateLimit-Policy": ""}},
+	})
+}
+
+func TestFailSafeRateLimiterWithCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	breaker, err := throttled.NewCircuitBreaker(throttled.CircuitBreakerConfig{MaxFailures: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := newFlakyStore(t)
+	quota := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 1}
+	limiter, err := throttled.NewGCRARateLimiterCtx(breaker.WrapStore(fs), quota)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewFailSafeRateLimiterCtx(limiter, throttled.FailFallback, newTestGCRA(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs.fail = true
+	for i, want := range []bool{false, false, true} {
+		limited, _, err := rl.RateLimitCtx(ctx, "foo", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limited != want {
+			t.Errorf("%d: expected the fallback to limit %t but got %t", i, want, limited)
+		}
+	}
+	if have := breaker.State(); have != throttled.CircuitOpen {
+		t.Errorf("expected the circuit to be open but it is %s", have)
+	}
+}
@@ -0,0 +1,251 @@
+package throttled
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// GraphQLCost returns a Cost function for HTTPRateLimiterCtx that
+// estimates the complexity of GraphQL requests. Each field selected by
+// a query costs 1, multiplied by the first or last argument of every
+// field enclosing it, which usually bounds the size of a list. For
+// example, the following query costs 71: 1 for users, 10 each for name
+// and friends, and 50 for the name of the friends.
+//
+//	{ users(first: 10) { name friends(first: 5) { name } } }
+//
+// The query is read from the query parameter of GET requests and from
+// the body of other requests, either as JSON like {"query": "..."},
+// with the costs of batched queries added up, or as the raw query if
+// the content type is application/graphql. At most maxBodySize bytes of
+// the body are read, and the body is restored so that the handler can
+// read it in full. Requests whose query can't be read, is larger than
+// maxBodySize or is malformed cost defaultCost.
+//
+// The estimate does not know the schema and counts the fields of named
+// fragments once where they are defined, so it is meant to be used
+// with limits that leave some headroom.
+func GraphQLCost(maxBodySize int64, defaultCost int) func(*http.Request) int {
+	return func(r *http.Request) int {
+		queries, ok := graphQLQueries(r, maxBodySize)
+		if !ok || len(queries) == 0 {
+			return defaultCost
+		}
+
+		total := 0
+		for _, q := range queries {
+			c := graphQLComplexity(q)
+			if c <= 0 {
+				return defaultCost
+			}
+			total = saturatingAdd(total, c)
+		}
+		return total
+	}
+}
+
+// graphQLQueries returns the queries of a GraphQL request and whether
+// they could be read.
+func graphQLQueries(r *http.Request, maxBodySize int64) ([]string, bool) {
+	if r.Method == http.MethodGet {
+		q := r.URL.Query().Get("query")
+		return []string{q}, q != ""
+	}
+
+	body, ok := peekBody(r, maxBodySize)
+	if !ok {
+		return nil, false
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/graphql" {
+		return []string{string(body)}, true
+	}
+
+	type request struct {
+		Query string `json:"query"`
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []request
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return nil, false
+		}
+		queries := make([]string, len(batch))
+		for i, req := range batch {
+			queries[i] = req.Query
+		}
+		return queries, true
+	}
+
+	var req request
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, false
+	}
+	return []string{req.Query}, true
+}
+
+// graphQLComplexity returns the estimated complexity of a GraphQL
+// document as described by GraphQLCost, or 0 if it is malformed.
+func graphQLComplexity(query string) int {
+	tokens, ok := graphQLTokens(query)
+	if !ok {
+		return 0
+	}
+
+	// multipliers holds the multiplier of each enclosing selection set
+	var multipliers []int
+	total := 0
+	parens := 0
+	pending := 1 // List size of the last field, applied to its selection set
+
+	for i, tok := range tokens {
+		var prev string
+		if i > 0 {
+			prev = tokens[i-1]
+		}
+
+		switch {
+		case tok == "(":
+			parens++
+		case tok == ")":
+			parens--
+			if parens < 0 {
+				return 0
+			}
+		case parens > 0:
+			// Arguments, in which braces are object values
+			if (prev == ":" && i > 1) && (tokens[i-2] == "first" || tokens[i-2] == "last") {
+				if n, err := strconv.Atoi(tok); err == nil && n > 0 {
+					pending = n
+				}
+			}
+		case tok == "{":
+			m := 1
+			if len(multipliers) > 0 {
+				m = saturatingMul(multipliers[len(multipliers)-1], pending)
+			}
+			multipliers = append(multipliers, m)
+			pending = 1
+		case tok == "}":
+			if len(multipliers) == 0 {
+				return 0
+			}
+			multipliers = multipliers[:len(multipliers)-1]
+		case tok == "...":
+			pending = 1
+		case len(multipliers) == 0 || !isGraphQLName(tok):
+			// Operation and fragment definitions, and punctuation
+		case prev == "..." || prev == "@" || prev == "on" && i > 1 && tokens[i-2] == "...":
+			// Fragment spreads, type conditions and directives
+		case i+1 < len(tokens) && tokens[i+1] == ":":
+			// Aliases, which are followed by the field name
+		default:
+			total = saturatingAdd(total, multipliers[len(multipliers)-1])
+			pending = 1
+		}
+	}
+
+	if len(multipliers) != 0 || parens != 0 {
+		return 0
+	}
+	return total
+}
+
+// graphQLTokens splits a GraphQL document into its punctuators, names
+// and numbers. String values are replaced by a single `"` token.
+// Whitespace, commas and comments are skipped.
+func graphQLTokens(s string) ([]string, bool) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(s) && s[i] != '\n' && s[i] != '\r' {
+				i++
+			}
+		case c == '"':
+			end, ok := graphQLStringEnd(s, i)
+			if !ok {
+				return nil, false
+			}
+			tokens = append(tokens, `"`)
+			i = end
+		case c == '.':
+			if i+3 > len(s) || s[i:i+3] != "..." {
+				return nil, false
+			}
+			tokens = append(tokens, "...")
+			i += 3
+		case isGraphQLNameChar(c) || c == '-':
+			j := i + 1
+			for j < len(s) && (isGraphQLNameChar(s[j]) || s[j] == '.' || s[j] == '+' || s[j] == '-') {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			tokens = append(tokens, s[i:i+1])
+			i++
+		}
+	}
+	return tokens, true
+}
+
+// graphQLStringEnd returns the index after the string or block string
+// starting at s[i].
+func graphQLStringEnd(s string, i int) (int, bool) {
+	if len(s) >= i+3 && s[i:i+3] == `"""` {
+		for j := i + 3; j+3 <= len(s); j++ {
+			if s[j] == '\\' && len(s) >= j+4 && s[j+1:j+4] == `"""` {
+				j += 3
+				continue
+			}
+			if s[j:j+3] == `"""` {
+				return j + 3, true
+			}
+		}
+		return 0, false
+	}
+
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '"':
+			return j + 1, true
+		case '\n', '\r':
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+func isGraphQLNameChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func isGraphQLName(tok string) bool {
+	c := tok[0]
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func saturatingAdd(a, b int) int {
+	if a > math.MaxInt32-b {
+		return math.MaxInt32
+	}
+	return a + b
+}
+
+func saturatingMul(a, b int) int {
+	if b != 0 && a > math.MaxInt32/b {
+		return math.MaxInt32
+	}
+	return a * b
+}
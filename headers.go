@@ -0,0 +1,218 @@
+package throttled
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A HeaderWriter writes headers describing the state of the rate
+// limiter for a request to its response.
+type HeaderWriter interface {
+	// WriteHeaders writes the headers for result to w. quota is the
+	// quota enforced for the request, or nil if the RateLimiter doesn't
+	// implement QuotaProvider or doesn't know it.
+	WriteHeaders(w http.ResponseWriter, quota *RateQuota, result RateLimitResult)
+}
+
+// ErrQuotaUnknown is returned by a QuotaProvider that can't tell the
+// quota it enforces for a key, such as a wrapper around a limiter that
+// isn't a QuotaProvider. HTTPRateLimiterCtx then serves the request
+// without describing the quota.
+var ErrQuotaUnknown = errors.New("quota is unknown")
+
+// A QuotaProvider is a RateLimiterCtx that can report the RateQuota it
+// enforces for a key, for example to describe it in response headers.
+type QuotaProvider interface {
+	QuotaCtx(ctx context.Context, key string) (RateQuota, error)
+}
+
+var (
+	// LegacyHeaders writes the X-RateLimit-Limit, X-RateLimit-Remaining
+	// and X-RateLimit-Reset headers, with the reset as a number of
+	// seconds from now, and the Retry-After header. It is the default
+	// HeaderWriter of HTTPRateLimiterCtx.
+	LegacyHeaders HeaderWriter = legacyHeaders{}
+
+	// GitHubHeaders writes the X-RateLimit-Limit, X-RateLimit-Remaining,
+	// X-RateLimit-Used and X-RateLimit-Reset headers in the style of the
+	// GitHub API, with the reset as the time in seconds since the epoch,
+	// and the Retry-After header.
+	GitHubHeaders HeaderWriter = gitHubHeaders{}
+
+	// NoHeaders writes no headers at all.
+	NoHeaders HeaderWriter = noHeaders{}
+)
+
+type legacyHeaders struct{}
+
+func (legacyHeaders) WriteHeaders(w http.ResponseWriter, _ *RateQuota, result RateLimitResult) {
+	if !mostRestrictive(w, result) {
+		writeRetryAfter(w, result)
+		return
+	}
+
+	if v := result.Limit; v >= 0 {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(v))
+	}
+
+	if v := result.Remaining; v >= 0 {
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(v))
+	}
+
+	if v := result.ResetAfter; v >= 0 {
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(v)))
+	}
+
+	writeRetryAfter(w, result)
+}
+
+type gitHubHeaders struct{}
+
+func (gitHubHeaders) WriteHeaders(w http.ResponseWriter, _ *RateQuota, result RateLimitResult) {
+	if !mostRestrictive(w, result) {
+		writeRetryAfter(w, result)
+		return
+	}
+
+	if v := result.Limit; v >= 0 {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(v))
+	}
+
+	w.Header().Del("X-RateLimit-Used")
+	if v := result.Remaining; v >= 0 {
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(v))
+		if result.Limit >= v {
+			w.Header().Set("X-RateLimit-Used", strconv.Itoa(result.Limit-v))
+		}
+	}
+
+	if v := result.ResetAfter; v >= 0 {
+		at := time.Now().Add(v)
+		reset := at.Unix()
+		if at.Nanosecond() > 0 {
+			reset++
+		}
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+	}
+
+	writeRetryAfter(w, result)
+}
+
+type noHeaders struct{}
+
+func (noHeaders) WriteHeaders(http.ResponseWriter, *RateQuota, RateLimitResult) {}
+
+// IETFHeaders is a HeaderWriter that writes the RateLimit and
+// RateLimit-Policy structured fields defined by the IETF draft
+// "RateLimit header fields for HTTP", and the Retry-After header. For
+// example, a quota of PerMin(1) with a MaxBurst of 9 is described as:
+//
+//	RateLimit-Policy: "default";q=10;w=600
+//	RateLimit: "default";r=9;t=60
+//
+// The window w of the policy is the time it takes for an exhausted
+// quota to be fully restored. RateLimit-Policy is only written if the
+// RateLimiter implements QuotaProvider.
+//
+// Both fields are lists, so stacked limiters, such as those of a
+// PolicyMux, each add their own policy to them. A policy that is
+// already listed is replaced, so stacked limiters should use distinct
+// Policy names.
+type IETFHeaders struct {
+	// Policy is the name identifying the quota in both fields. If it
+	// is empty, "default" is used.
+	Policy string
+}
+
+// WriteHeaders writes the RateLimit, RateLimit-Policy and Retry-After
+// headers for result to w.
+func (h IETFHeaders) WriteHeaders(w http.ResponseWriter, quota *RateQuota, result RateLimitResult) {
+	policy := h.Policy
+	if policy == "" {
+		policy = "default"
+	}
+	name := sfString(policy)
+
+	if quota != nil {
+		limit := quota.MaxBurst + 1
+		window := quota.MaxRate.period * time.Duration(limit)
+		addListMember(w.Header(), "RateLimit-Policy", name, name+";q="+strconv.Itoa(limit)+";w="+strconv.Itoa(ceilSeconds(window)))
+	}
+
+	if v := result.Remaining; v >= 0 {
+		field := name + ";r=" + strconv.Itoa(v)
+		if reset := result.ResetAfter; reset >= 0 {
+			field += ";t=" + strconv.Itoa(ceilSeconds(reset))
+		}
+		addListMember(w.Header(), "RateLimit", name, field)
+	}
+
+	writeRetryAfter(w, result)
+}
+
+// mostRestrictive reports whether result is more restrictive than the
+// result whose X-RateLimit headers were already written to w, if any,
+// so that only the most restrictive of several stacked limiters, such
+// as those of a PolicyMux, is reported. Like MultiRateLimiterCtx, it
+// compares the remaining requests and then the limits.
+func mostRestrictive(w http.ResponseWriter, result RateLimitResult) bool {
+	remaining, err := strconv.Atoi(w.Header().Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return true
+	}
+	if result.Remaining != remaining {
+		return result.Remaining >= 0 && result.Remaining < remaining
+	}
+	limit, err := strconv.Atoi(w.Header().Get("X-RateLimit-Limit"))
+	return err != nil || result.Limit >= 0 && result.Limit < limit
+}
+
+// writeRetryAfter writes the Retry-After header unless a longer one was
+// already written by another limiter.
+func writeRetryAfter(w http.ResponseWriter, result RateLimitResult) {
+	v := result.RetryAfter
+	if v < 0 {
+		return
+	}
+	seconds := ceilSeconds(v)
+	if prev, err := strconv.Atoi(w.Header().Get("Retry-After")); err == nil && prev >= seconds {
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// addListMember adds member to the values of the header key, replacing
+// the values of a member with the same name.
+func addListMember(h http.Header, key, name, member string) {
+	key = http.CanonicalHeaderKey(key)
+	var values []string
+	for _, v := range h[key] {
+		if !strings.HasPrefix(v, name+";") {
+			values = append(values, v)
+		}
+	}
+	h[key] = append(values, member)
+}
+
+// sfString encodes s as a string of a structured field.
+func sfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		if c == '"' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
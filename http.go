@@ -1,10 +1,11 @@
 package throttled
 
 import (
+	"context"
 	"errors"
-	"math"
+	"net"
 	"net/http"
-	"strconv"
+	"time"
 )
 
 var (
@@ -24,6 +25,10 @@ var (
 
 // HTTPRateLimiterCtx facilitates using a Limiter to limit HTTP requests.
 type HTTPRateLimiterCtx struct {
+	// Name identifies the policy enforced by the limiter, such as
+	// "login". It is reported as the Policy of the RateLimitInfo.
+	Name string
+
 	// DeniedHandler is called if the request is disallowed. If it is
 	// nil, the DefaultDeniedHandler variable is used.
 	DeniedHandler http.Handler
@@ -41,46 +46,256 @@ type HTTPRateLimiterCtx struct {
 	VaryBy interface {
 		Key(*http.Request) string
 	}
+
+	// Headers writes the headers describing the state of the limiter
+	// to each response. If it is nil, LegacyHeaders is used.
+	Headers HeaderWriter
+
+	// Cost is called for each request to determine the quantity it
+	// counts against the limit, so that expensive requests use up more
+	// of it. A cost of 0 admits the request without counting it. If it
+	// is nil, each request counts as 1.
+	Cost func(*http.Request) int
+
+	// ChargeAfter, if set, makes requests count against the limit
+	// after they have been served rather than before, for example to
+	// only count failed logins or to charge by the size of responses.
+	// Each request is only admitted if some of the limit remains, which
+	// is checked without counting the request. Once the handler returns,
+	// ChargeAfter is called with the status code and number of body
+	// bytes written, and the quantity it returns is counted against the
+	// limit. If it exceeds what remains of the limit, the remainder is
+	// used up instead. Cost is not used. Errors occurring while charging
+	// can't be reported, as the response has already been written.
+	ChargeAfter func(status int, bytesWritten int64, r *http.Request) int
+
+	// Skip is called for each request before anything else, and
+	// requests for which it returns true, such as health checks, are
+	// passed to the handler without being rate limited.
+	Skip func(*http.Request) bool
+
+	// AllowCIDRs and AllowKeys list the client networks and keys of
+	// requests that are passed to the handler without being rate
+	// limited.
+	AllowCIDRs []*net.IPNet
+	AllowKeys  []string
+
+	// DenyCIDRs and DenyKeys list the client networks and keys of
+	// requests that are passed to the DeniedHandler without consulting
+	// the RateLimiter. They take precedence over AllowCIDRs and
+	// AllowKeys.
+	DenyCIDRs []*net.IPNet
+	DenyKeys  []string
+
+	// ClientIP determines the client IP matched against AllowCIDRs and
+	// DenyCIDRs. If it is nil, the IP of the RemoteAddr is used.
+	ClientIP *ClientIP
+
+	// DryRun, if set, passes all requests to the handler, including
+	// those the RateLimiter limits and those for which it returns an
+	// error. No headers are written. The decisions that would have been
+	// made can be observed with Report.
+	DryRun bool
+
+	// Report, if set, is called with the decision made for each request
+	// that is neither skipped nor allowed, for example to record
+	// metrics. In DryRun mode, the RateLimitInfo describes the decision
+	// that would have been made.
+	Report func(r *http.Request, info RateLimitInfo)
 }
 
 // RateLimit wraps an http.Handler to limit incoming requests.
 // Requests that are not limited will be passed to the handler
 // unchanged.  Limited requests will be passed to the DeniedHandler.
-// X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset and
-// Retry-After headers will be written to the response based on the
-// values in the RateLimitResult.
+// Headers describing the RateLimitResult are written to the response
+// by the HeaderWriter, which by default writes X-RateLimit-Limit,
+// X-RateLimit-Remaining, X-RateLimit-Reset and Retry-After headers.
+// Both handlers can retrieve the outcome with RateLimitInfoFromContext.
+// Requests that are skipped or on the allow or deny lists are passed on
+// without calling the RateLimiter.
 func (t *HTTPRateLimiterCtx) RateLimit(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if t.RateLimiter == nil {
 			t.error(w, r, errors.New("You must set a RateLimiter on HTTPRateLimiter"))
 		}
 
+		if t.Skip != nil && t.Skip(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
 		var k string
 		if t.VaryBy != nil {
 			k = t.VaryBy.Key(r)
 		}
 
-		limited, context, err := t.RateLimiter.RateLimitCtx(r.Context(), k, 1)
+		if denied, allowed := t.listed(r, k); denied {
+			info := RateLimitInfo{
+				Policy:  t.Name,
+				Key:     k,
+				Result:  RateLimitResult{Limit: -1, Remaining: -1, ResetAfter: -1, RetryAfter: -1},
+				Limited: true,
+				DryRun:  t.DryRun,
+			}
+			if t.Report != nil {
+				t.Report(r, info)
+			}
+			r = r.WithContext(withRateLimitInfo(r.Context(), info))
+			if t.DryRun {
+				h.ServeHTTP(w, r)
+			} else {
+				t.deny(w, r)
+			}
+			return
+		} else if allowed {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		quantity := 1
+		if t.ChargeAfter != nil {
+			quantity = 0
+		} else if t.Cost != nil {
+			if quantity = t.Cost(r); quantity < 0 {
+				quantity = 0
+			}
+		}
+
+		limited, result, err := t.RateLimiter.RateLimitCtx(r.Context(), k, quantity)
 
 		if err != nil {
-			t.error(w, r, err)
+			t.fail(w, r, h, err)
 			return
 		}
 
-		setRateLimitHeaders(w, context)
+		var quota *RateQuota
+		if qp, ok := t.RateLimiter.(QuotaProvider); ok {
+			q, err := qp.QuotaCtx(r.Context(), k)
+			switch {
+			case err == ErrQuotaUnknown:
+			case err != nil:
+				t.fail(w, r, h, err)
+				return
+			default:
+				quota = &q
+			}
+		}
 
-		if !limited {
-			h.ServeHTTP(w, r)
-		} else {
-			dh := t.DeniedHandler
-			if dh == nil {
-				dh = DefaultDeniedHandler
+		// A request that is only peeked at is permitted even if less than
+		// one request remains
+		if t.ChargeAfter != nil && !limited && result.Remaining == 0 {
+			limited = true
+			result.RetryAfter = peekRetryAfter(r.Context(), t.RateLimiter, k, result)
+		}
+
+		info := RateLimitInfo{Policy: t.Name, Key: k, Quota: quota, Result: result, Limited: limited, DryRun: t.DryRun}
+		if t.Report != nil {
+			t.Report(r, info)
+		}
+
+		if !t.DryRun {
+			hw := t.Headers
+			if hw == nil {
+				hw = LegacyHeaders
 			}
-			dh.ServeHTTP(w, r)
+			hw.WriteHeaders(w, quota, result)
 		}
+
+		r = r.WithContext(withRateLimitInfo(r.Context(), info))
+		if limited && !t.DryRun {
+			t.deny(w, r)
+			return
+		}
+
+		if t.ChargeAfter == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec.wrap(w), r)
+		t.charge(k, r, rec)
 	})
 }
 
+// listed reports whether the client or key of a request is on the deny
+// list or the allow list.
+func (t *HTTPRateLimiterCtx) listed(r *http.Request, key string) (denied, allowed bool) {
+	var ip net.IP
+	if len(t.DenyCIDRs) > 0 || len(t.AllowCIDRs) > 0 {
+		ip = t.ClientIP.IP(r)
+	}
+
+	if ip != nil && containsIP(t.DenyCIDRs, ip) || containsString(t.DenyKeys, key) {
+		return true, false
+	}
+	return false, ip != nil && containsIP(t.AllowCIDRs, ip) || containsString(t.AllowKeys, key)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *HTTPRateLimiterCtx) deny(w http.ResponseWriter, r *http.Request) {
+	dh := t.DeniedHandler
+	if dh == nil {
+		dh = DefaultDeniedHandler
+	}
+	dh.ServeHTTP(w, r)
+}
+
+// charge counts the quantity returned by ChargeAfter for a served
+// request against the limit.
+func (t *HTTPRateLimiterCtx) charge(key string, r *http.Request, rec *responseRecorder) {
+	quantity := t.ChargeAfter(rec.statusCode(), rec.bytes, r)
+	if quantity <= 0 {
+		return
+	}
+
+	// The request context may be cancelled once the response has been
+	// written, but the request must still be counted.
+	ctx := context.Background()
+	limited, result, err := t.RateLimiter.RateLimitCtx(ctx, key, quantity)
+	if err == nil && limited && result.Remaining > 0 {
+		t.RateLimiter.RateLimitCtx(ctx, key, result.Remaining)
+	}
+}
+
+// peekRetryAfter returns the time until one request will be permitted
+// for key after peeking at a limit that has less than one request
+// remaining. Unless the limiter implements Peeker, it is the time until
+// the limit is reset.
+func peekRetryAfter(ctx context.Context, limiter RateLimiterCtx, key string, result RateLimitResult) time.Duration {
+	p, ok := limiter.(Peeker)
+	if !ok {
+		return result.ResetAfter
+	}
+	peeked, err := p.PeekCtx(ctx, key, 1)
+	if err != nil {
+		return result.ResetAfter
+	}
+	if peeked.RetryAfter < 0 {
+		// A request was permitted again in the meantime
+		return 0
+	}
+	return peeked.RetryAfter
+}
+
+// fail handles an error returned by the RateLimiter, which is ignored in
+// DryRun mode.
+func (t *HTTPRateLimiterCtx) fail(w http.ResponseWriter, r *http.Request, h http.Handler, err error) {
+	if t.DryRun {
+		h.ServeHTTP(w, r)
+		return
+	}
+	t.error(w, r, err)
+}
+
 func (t *HTTPRateLimiterCtx) error(w http.ResponseWriter, r *http.Request, err error) {
 	e := t.Error
 	if e == nil {
@@ -89,22 +304,113 @@ func (t *HTTPRateLimiterCtx) error(w http.ResponseWriter, r *http.Request, err e
 	e(w, r, err)
 }
 
-func setRateLimitHeaders(w http.ResponseWriter, context RateLimitResult) {
-	if v := context.Limit; v >= 0 {
-		w.Header().Add("X-RateLimit-Limit", strconv.Itoa(v))
-	}
+// HTTPConcurrencyLimiterCtx facilitates using a ConcurrencyLimiterCtx to
+// limit the number of HTTP requests in progress at the same time.
+type HTTPConcurrencyLimiterCtx struct {
+	// DeniedHandler is called if the request is disallowed. If it is
+	// nil, the DefaultDeniedHandler variable is used.
+	DeniedHandler http.Handler
+
+	// Error is called if the ConcurrencyLimiter returns an error. If it
+	// is nil, the DefaultErrorFunc is used.
+	Error func(w http.ResponseWriter, r *http.Request, err error)
+
+	// ConcurrencyLimiter is called for each request to acquire a slot
+	// that is held while the request is served. It must be set.
+	ConcurrencyLimiter ConcurrencyLimiterCtx
 
-	if v := context.Remaining; v >= 0 {
-		w.Header().Add("X-RateLimit-Remaining", strconv.Itoa(v))
+	// VaryBy is called for each request to generate a key for the
+	// limiter. If it is nil, all requests use an empty string key.
+	VaryBy interface {
+		Key(*http.Request) string
 	}
 
-	if v := context.ResetAfter; v >= 0 {
-		vi := int(math.Ceil(v.Seconds()))
-		w.Header().Add("X-RateLimit-Reset", strconv.Itoa(vi))
+	// RenewInterval is how often the lease of a request in progress is
+	// extended, which costs a call to the store per interval for each
+	// request. It should be a fraction of the lease TTL, such as a
+	// third, so that a failed extension can be retried before the lease
+	// expires. If it is zero, leases are not extended, so requests that
+	// take longer than the lease TTL stop counting against the limit.
+	RenewInterval time.Duration
+}
+
+// Limit wraps an http.Handler to limit the number of requests in
+// progress at the same time. Requests that acquire a slot will be
+// passed to the handler unchanged and the slot is released when the
+// handler returns. Limited requests will be passed to the
+// DeniedHandler.
+func (t *HTTPConcurrencyLimiterCtx) Limit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t.ConcurrencyLimiter == nil {
+			t.error(w, r, errors.New("You must set a ConcurrencyLimiter on HTTPConcurrencyLimiterCtx"))
+			return
+		}
+
+		var k string
+		if t.VaryBy != nil {
+			k = t.VaryBy.Key(r)
+		}
+
+		limited, lease, err := t.ConcurrencyLimiter.AcquireCtx(r.Context(), k)
+
+		if err != nil {
+			t.error(w, r, err)
+			return
+		}
+
+		if limited {
+			dh := t.DeniedHandler
+			if dh == nil {
+				dh = DefaultDeniedHandler
+			}
+			dh.ServeHTTP(w, r)
+			return
+		}
+
+		// The request context may be cancelled by the time the handler
+		// returns. A slot that can't be released is reclaimed when its
+		// lease expires.
+		defer lease.Release(context.Background())
+
+		if t.RenewInterval > 0 {
+			defer t.renew(lease)()
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// renew extends lease every RenewInterval until the returned function
+// is called. Failed extensions are retried at the next interval unless
+// the lease has expired, as its slot may have been taken since.
+func (t *HTTPConcurrencyLimiterCtx) renew(lease Lease) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(t.RenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := lease.Extend(ctx); err == ErrLeaseExpired {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
 	}
+}
 
-	if v := context.RetryAfter; v >= 0 {
-		vi := int(math.Ceil(v.Seconds()))
-		w.Header().Add("Retry-After", strconv.Itoa(vi))
+func (t *HTTPConcurrencyLimiterCtx) error(w http.ResponseWriter, r *http.Request, err error) {
+	e := t.Error
+	if e == nil {
+		e = DefaultError
 	}
+	e(w, r, err)
 }
@@ -5,10 +5,13 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/throttled/throttled/v2"
+	"github.com/throttled/throttled/v2/store/memstore"
 )
 
 type stubLimiter struct {
@@ -89,6 +92,108 @@ func TestCustomHTTPRateLimiterHandlers(t *testing.T) {
 	})
 }
 
+func TestHTTPRateLimiterHeaders(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 1}
+	for _, c := range []struct {
+		name    string
+		headers throttled.HeaderWriter
+		cases   []httpTestCase
+	}{
+		{"legacy", nil, []httpTestCase{
+			{"a", 200, map[string]string{"X-Ratelimit-Limit": "2", "X-Ratelimit-Remaining": "1", "X-Ratelimit-Reset": "60", "RateLimit": ""}},
+		}},
+		{"ietf", throttled.IETFHeaders{Policy: "api"}, []httpTestCase{
+			{"a", 200, map[string]string{"RateLimit-Policy": `"api";q=2;w=120`, "RateLimit": `"api";r=1;t=60`, "X-Ratelimit-Limit": ""}},
+			{"a", 200, map[string]string{"RateLimit": `"api";r=0;t=120`, "Retry-After": ""}},
+			{"a", 429, map[string]string{"RateLimit": `"api";r=0;t=120`, "Retry-After": "60"}},
+		}},
+		{"none", throttled.NoHeaders, []httpTestCase{
+			{"a", 200, map[string]string{"X-Ratelimit-Limit": "", "RateLimit": "", "RateLimit-Policy": ""}},
+		}},
+	} {
+		mst, err := memstore.NewCtx(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rl, err := throttled.NewGCRARateLimiterCtx(&testStore{store: mst, clock: time.Unix(0, 0)}, rq)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		limiter := throttled.HTTPRateLimiterCtx{
+			RateLimiter: rl,
+			VaryBy:      &pathGetter{},
+			Headers:     c.headers,
+		}
+		handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(200)
+		}))
+
+		t.Run(c.name, func(t *testing.T) {
+			runHTTPTestCases(t, handler, c.cases)
+		})
+	}
+}
+
+func TestHTTPRateLimiterIETFHeadersWithoutQuota(t *testing.T) {
+	limiter := throttled.HTTPRateLimiterCtx{
+		RateLimiter: &stubLimiter{},
+		VaryBy:      &pathGetter{},
+		Headers:     throttled.IETFHeaders{},
+	}
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"ok", 200, map[string]string{"RateLimit": `"default";r=2;t=60`, "RateLimit-Policy": ""}},
+	})
+}
+
+func TestIETFHeadersStacked(t *testing.T) {
+	rr := httptest.NewRecorder()
+	result := throttled.RateLimitResult{Limit: 2, Remaining: 1, ResetAfter: time.Minute, RetryAfter: -1}
+	throttled.IETFHeaders{Policy: "global"}.WriteHeaders(rr, nil, result)
+	throttled.IETFHeaders{Policy: "route"}.WriteHeaders(rr, nil, result)
+	result.Remaining = 0
+	throttled.IETFHeaders{Policy: "route"}.WriteHeaders(rr, nil, result)
+
+	want := []string{`"global";r=1;t=60`, `"route";r=0;t=60`}
+	if have := rr.Header()["Ratelimit"]; !reflect.DeepEqual(have, want) {
+		t.Errorf("expected RateLimit to be %v but got %v", want, have)
+	}
+}
+
+func TestHTTPRateLimiterGitHubHeaders(t *testing.T) {
+	limiter := throttled.HTTPRateLimiterCtx{
+		RateLimiter: &stubLimiter{},
+		VaryBy:      &pathGetter{},
+		Headers:     throttled.GitHubHeaders,
+	}
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	before := time.Now().Unix()
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/ok", nil))
+	after := time.Now().Unix()
+
+	for name, want := range map[string]string{"X-Ratelimit-Limit": "1", "X-Ratelimit-Remaining": "2", "X-Ratelimit-Used": ""} {
+		if have := rr.Header().Get(name); have != want {
+			t.Errorf("expected header '%s: %s' but got '%s'", name, want, have)
+		}
+	}
+
+	reset, err := strconv.ParseInt(rr.Header().Get("X-Ratelimit-Reset"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reset < before+60 || reset > after+61 {
+		t.Errorf("expected X-Ratelimit-Reset to be a minute from now but got %d", reset)
+	}
+}
+
 func runHTTPTestCases(t *testing.T, h http.Handler, cs []httpTestCase) {
 	for i, c := range cs {
 		req, err := http.NewRequest("GET", c.path, nil)
@@ -129,3 +234,116 @@ func BenchmarkHTTPRateLimiter(b *testing.B) {
 	}
 	_ = w.Body
 }
+
+type countingLimiter struct {
+	calls int
+}
+
+func (cl *countingLimiter) RateLimitCtx(_ context.Context, key string, quantity int) (bool, throttled.RateLimitResult, error) {
+	cl.calls++
+	return false, throttled.RateLimitResult{Limit: 1, Remaining: 1, ResetAfter: -1, RetryAfter: -1}, nil
+}
+
+func TestHTTPRateLimiterSkipAndLists(t *testing.T) {
+	office, err := throttled.ParseCIDRs("192.0.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	abusive, err := throttled.ParseCIDRs("192.0.2.66", "198.51.100.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rl := &countingLimiter{}
+	var limited bool
+	limiter := throttled.HTTPRateLimiterCtx{
+		RateLimiter: rl,
+		VaryBy:      &pathGetter{},
+		Skip: func(r *http.Request) bool {
+			return r.URL.Path == "/healthz"
+		},
+		AllowCIDRs: office,
+		AllowKeys:  []string{"/internal"},
+		DenyCIDRs:  abusive,
+		DenyKeys:   []string{"/banned"},
+		ClientIP:   &throttled.ClientIP{Header: "X-Real-IP", TrustedHops: 1},
+		DeniedHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info, _ := throttled.RateLimitInfoFromContext(r.Context())
+			limited = info.Limited
+			w.WriteHeader(403)
+		}),
+	}
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, c := range []struct {
+		path, remoteAddr, realIP string
+		code                     int
+		calls                    int
+	}{
+		0: {"/healthz", "198.51.100.1:1234", "", 200, 0},
+		1: {"/", "203.0.113.1:1234", "", 200, 1},
+		2: {"/", "192.0.2.1:1234", "", 200, 0},
+		3: {"/internal", "203.0.113.1:1234", "", 200, 0},
+		4: {"/", "198.51.100.1:1234", "", 403, 0},
+		5: {"/", "192.0.2.66:1234", "", 403, 0},
+		6: {"/banned", "192.0.2.1:1234", "", 403, 0},
+		7: {"/", "10.0.0.1:1234", "192.0.2.1", 200, 0},
+		8: {"/", "10.0.0.1:1234", "198.51.100.1", 403, 0},
+	} {
+		rl.calls, limited = 0, false
+		r := httptest.NewRequest("GET", c.path, nil)
+		r.RemoteAddr = c.remoteAddr
+		if c.realIP != "" {
+			r.Header.Set("X-Real-IP", c.realIP)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+
+		if rr.Code != c.code {
+			t.Errorf("%d: expected status %d but got %d", i, c.code, rr.Code)
+		}
+		if rl.calls != c.calls {
+			t.Errorf("%d: expected %d calls to the RateLimiter but got %d", i, c.calls, rl.calls)
+		}
+		if c.code == 403 && !limited {
+			t.Errorf("%d: expected the request to be limited in the context", i)
+		}
+	}
+}
+
+func TestHTTPRateLimiterDryRun(t *testing.T) {
+	var reported []throttled.RateLimitInfo
+	var served throttled.RateLimitInfo
+	limiter := throttled.HTTPRateLimiterCtx{
+		RateLimiter: &stubLimiter{},
+		VaryBy:      &pathGetter{},
+		DenyKeys:    []string{"banned"},
+		DryRun:      true,
+		Report: func(r *http.Request, info throttled.RateLimitInfo) {
+			reported = append(reported, info)
+		},
+	}
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served, _ = throttled.RateLimitInfoFromContext(r.Context())
+		w.WriteHeader(200)
+	}))
+
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"ok", 200, map[string]string{"X-Ratelimit-Limit": ""}},
+		{"limit", 200, map[string]string{"Retry-After": ""}},
+		{"error", 200, map[string]string{}},
+		{"banned", 200, map[string]string{}},
+	})
+
+	if len(reported) != 3 {
+		t.Fatalf("expected 3 reports but got %d", len(reported))
+	}
+	for i, limited := range []bool{false, true, true} {
+		if reported[i].Limited != limited || !reported[i].DryRun {
+			t.Errorf("%d: expected limited %t in a dry run but got %+v", i, limited, reported[i])
+		}
+	}
+	if served.Key != "banned" || !served.Limited {
+		t.Errorf("expected the handler to see the would-be decision but got %+v", served)
+	}
+}
@@ -0,0 +1,193 @@
+package throttled
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// A QuotaResolver returns the RateQuota to enforce for a key, for
+// example based on the plan of the tenant the key belongs to.
+type QuotaResolver interface {
+	ResolveQuota(ctx context.Context, key string) (RateQuota, error)
+}
+
+// QuotaResolverFunc is an adapter to allow the use of ordinary
+// functions as QuotaResolvers.
+type QuotaResolverFunc func(ctx context.Context, key string) (RateQuota, error)
+
+// ResolveQuota calls f(ctx, key).
+func (f QuotaResolverFunc) ResolveQuota(ctx context.Context, key string) (RateQuota, error) {
+	return f(ctx, key)
+}
+
+// KeyedGCRARateLimiterCtx is a RateLimiter that uses the generic
+// cell-rate algorithm like GCRARateLimiterCtx, but resolves the quota
+// to enforce for each key when it is rate limited. All keys share one
+// store regardless of their quota.
+//
+// When the quota resolved for a key changes, its stored state is
+// interpreted under the new quota like after GCRARateLimiterCtx.UpdateQuota:
+// the time until the key returns to its initial state carries over
+// unchanged, but a key that was further ahead of its schedule than the
+// new quota tolerates is treated as having just exhausted the new burst.
+// Because a key may move to a smaller quota at any time, keys with a
+// smaller burst duration than the largest quota enforced so far are
+// always checked for this, which uses compare-and-swap even when the
+// store supports atomic updates.
+type KeyedGCRARateLimiterCtx struct {
+	store    GCRAStoreCtx
+	resolver QuotaResolver
+
+	// cache holds a cachedQuota for recently resolved keys, or is nil
+	// if caching is disabled.
+	cache    *lru.Cache
+	cacheTTL time.Duration
+
+	// limiters holds the *GCRARateLimiterCtx enforcing each of up to
+	// maxKeyedLimiters recently used quotas. tolerance is the largest
+	// burst duration of any quota enforced so far.
+	mu        sync.Mutex
+	limiters  *lru.Cache
+	tolerance time.Duration
+}
+
+// maxKeyedLimiters is the number of quotas for which a
+// KeyedGCRARateLimiterCtx keeps a limiter. Limiters are cheap to create
+// again, so this only bounds memory use when quotas are resolved from
+// unbounded input.
+const maxKeyedLimiters = 256
+
+type cachedQuota struct {
+	quota   RateQuota
+	expires time.Time
+}
+
+// NewKeyedGCRARateLimiterCtx creates a KeyedGCRARateLimiterCtx which
+// calls resolver to find the quota of each key. Resolved quotas of up
+// to cacheSize keys are cached for cacheTTL, or until they are evicted
+// to make room for other keys if cacheTTL <= 0. If cacheSize <= 0,
+// resolver is called every time a key is rate limited.
+func NewKeyedGCRARateLimiterCtx(st GCRAStoreCtx, resolver QuotaResolver, cacheSize int, cacheTTL time.Duration) (*KeyedGCRARateLimiterCtx, error) {
+	limiters, err := lru.New(maxKeyedLimiters)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &KeyedGCRARateLimiterCtx{
+		store:    st,
+		resolver: resolver,
+		cacheTTL: cacheTTL,
+		limiters: limiters,
+	}
+
+	if cacheSize > 0 {
+		cache, err := lru.New(cacheSize)
+		if err != nil {
+			return nil, err
+		}
+		k.cache = cache
+	}
+
+	return k, nil
+}
+
+// RateLimitCtx checks whether a particular key has exceeded the rate
+// limit resolved for it. It also returns a RateLimitResult to provide
+// additional information about the state of the RateLimiter.
+//
+// If the rate limit has not been exceeded, the underlying storage is
+// updated by the supplied quantity. If quantity is 0, no update is
+// performed allowing you to "peek" at the state of the RateLimiter for
+// a given key.
+func (k *KeyedGCRARateLimiterCtx) RateLimitCtx(ctx context.Context, key string, quantity int) (bool, RateLimitResult, error) {
+	l, err := k.limiter(ctx, key)
+	if err != nil {
+		return false, RateLimitResult{}, err
+	}
+	return l.RateLimitCtx(ctx, key, quantity)
+}
+
+// PeekCtx returns the state of key under the rate limit resolved for
+// it without updating it, with RetryAfter set to the time until quantity
+// would be permitted, or -1 if it would be permitted now or never.
+func (k *KeyedGCRARateLimiterCtx) PeekCtx(ctx context.Context, key string, quantity int) (RateLimitResult, error) {
+	l, err := k.limiter(ctx, key)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return l.PeekCtx(ctx, key, quantity)
+}
+
+// QuotaCtx returns the quota enforced for key, resolving it if it
+// isn't cached.
+func (k *KeyedGCRARateLimiterCtx) QuotaCtx(ctx context.Context, key string) (RateQuota, error) {
+	return k.resolve(ctx, key)
+}
+
+// limiter returns the GCRARateLimiterCtx enforcing the quota of key.
+// Limiters are shared by all keys with the same quota.
+func (k *KeyedGCRARateLimiterCtx) limiter(ctx context.Context, key string) (*GCRARateLimiterCtx, error) {
+	quota, err := k.resolve(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if v, ok := k.limiters.Get(quota); ok {
+		return v.(*GCRARateLimiterCtx), nil
+	}
+
+	l, err := NewGCRARateLimiterCtx(k.store, quota)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys may have been limited under a larger quota before
+	switch tolerance := l.loadParams().delayVariationTolerance; {
+	case tolerance < k.tolerance:
+		l.clampAlways()
+	case tolerance > k.tolerance:
+		k.tolerance = tolerance
+		for _, q := range k.limiters.Keys() {
+			if v, ok := k.limiters.Peek(q); ok {
+				if other := v.(*GCRARateLimiterCtx); other.loadParams().delayVariationTolerance < tolerance {
+					other.clampAlways()
+				}
+			}
+		}
+	}
+
+	k.limiters.Add(quota, l)
+	return l, nil
+}
+
+func (k *KeyedGCRARateLimiterCtx) resolve(ctx context.Context, key string) (RateQuota, error) {
+	if k.cache == nil {
+		return k.resolver.ResolveQuota(ctx, key)
+	}
+
+	if v, ok := k.cache.Get(key); ok {
+		c := v.(cachedQuota)
+		if c.expires.IsZero() || time.Now().Before(c.expires) {
+			return c.quota, nil
+		}
+	}
+
+	quota, err := k.resolver.ResolveQuota(ctx, key)
+	if err != nil {
+		return quota, err
+	}
+
+	c := cachedQuota{quota: quota}
+	if k.cacheTTL > 0 {
+		c.expires = time.Now().Add(k.cacheTTL)
+	}
+	k.cache.Add(key, c)
+
+	return quota, nil
+}
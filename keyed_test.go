@@ -0,0 +1,195 @@
+package throttled_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled/v2"
+	"github.com/throttled/throttled/v2/store/memstore"
+)
+
+func TestKeyedRateLimit(t *testing.T) {
+	basic := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 0}
+	premium := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 2}
+
+	calls := map[string]int{}
+	resolver := throttled.QuotaResolverFunc(func(ctx context.Context, key string) (throttled.RateQuota, error) {
+		calls[key]++
+		if key == "premium" {
+			return premium, nil
+		}
+		return basic, nil
+	})
+
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := testStore{store: mst, clock: time.Unix(0, 0)}
+
+	rl, err := throttled.NewKeyedGCRARateLimiterCtx(&st, resolver, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		key              string
+		limit, remaining int
+		limited          bool
+	}{
+		0: {"basic", 1, 0, false},
+		1: {"basic", 1, 0, true},
+		2: {"premium", 3, 2, false},
+		3: {"premium", 3, 1, false},
+		4: {"premium", 3, 0, false},
+		5: {"premium", 3, 0, true},
+	}
+
+	for i, c := range cases {
+		limited, result, err := rl.RateLimitCtx(context.Background(), c.key, 1)
+		if err != nil {
+			t.Fatalf("%d: %#v", i, err)
+		}
+		if limited != c.limited {
+			t.Errorf("%d: expected Limited to be %t but got %t", i, c.limited, limited)
+		}
+		if have, want := result.Limit, c.limit; have != want {
+			t.Errorf("%d: expected Limit to be %d but got %d", i, want, have)
+		}
+		if have, want := result.Remaining, c.remaining; have != want {
+			t.Errorf("%d: expected Remaining to be %d but got %d", i, want, have)
+		}
+	}
+
+	for key, n := range calls {
+		if n != 1 {
+			t.Errorf("expected the quota of %s to be resolved once but it was resolved %d times", key, n)
+		}
+	}
+}
+
+func TestKeyedRateLimitCache(t *testing.T) {
+	quota := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 5}
+
+	calls := 0
+	resolver := throttled.QuotaResolverFunc(func(ctx context.Context, key string) (throttled.RateQuota, error) {
+		calls++
+		return quota, nil
+	})
+
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, c := range []struct {
+		size  int
+		ttl   time.Duration
+		sleep time.Duration
+		calls int
+	}{
+		// Caching disabled
+		{0, 0, 0, 3},
+		// Cached entries never expire
+		{10, 0, 0, 1},
+		// Cached entries expire between requests
+		{10, time.Millisecond, 5 * time.Millisecond, 3},
+	} {
+		calls = 0
+		rl, err := throttled.NewKeyedGCRARateLimiterCtx(mst, resolver, c.size, c.ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if _, _, err := rl.RateLimitCtx(ctx, "foo", 1); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(c.sleep)
+		}
+		if calls != c.calls {
+			t.Errorf("size %d, ttl %s: expected %d resolver calls but got %d", c.size, c.ttl, c.calls, calls)
+		}
+	}
+}
+
+func TestKeyedRateLimitResolverError(t *testing.T) {
+	resolveErr := errors.New("unknown tenant")
+	resolver := throttled.QuotaResolverFunc(func(ctx context.Context, key string) (throttled.RateQuota, error) {
+		if key == "invalid" {
+			return throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: -1}, nil
+		}
+		return throttled.RateQuota{}, resolveErr
+	})
+
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewKeyedGCRARateLimiterCtx(mst, resolver, 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := rl.RateLimitCtx(context.Background(), "foo", 1); err != resolveErr {
+		t.Errorf("expected the resolver error but got %v", err)
+	}
+	if _, _, err := rl.RateLimitCtx(context.Background(), "invalid", 1); err == nil {
+		t.Error("expected an invalid resolved quota to fail")
+	}
+}
+
+func TestKeyedRateLimitQuotaChange(t *testing.T) {
+	basic := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 0}
+	premium := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 9}
+
+	for _, atomic := range []bool{false, true} {
+		quotas := map[string]throttled.RateQuota{"foo": premium, "bar": basic}
+		resolver := throttled.QuotaResolverFunc(func(ctx context.Context, key string) (throttled.RateQuota, error) {
+			return quotas[key], nil
+		})
+
+		mst, err := memstore.NewCtx(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := &testStore{store: mst, clock: time.Unix(0, 0)}
+		var st throttled.GCRAStoreCtx = ts
+		if atomic {
+			st = &atomicTestStore{testStore: ts}
+		}
+		rl, err := throttled.NewKeyedGCRARateLimiterCtx(st, resolver, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The limiter of the smaller quota exists before the larger one
+		ctx := context.Background()
+		if _, _, err := rl.RateLimitCtx(ctx, "bar", 1); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if limited, _, err := rl.RateLimitCtx(ctx, "foo", 1); err != nil || limited {
+				t.Fatalf("atomic %t: expected request %d to be permitted but got %t, %v", atomic, i, limited, err)
+			}
+		}
+
+		// The key exhausted the burst of the smaller quota after moving to it
+		quotas["foo"] = basic
+		ts.clock = ts.clock.Add(time.Second)
+		limited, result, err := rl.RateLimitCtx(ctx, "foo", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !limited || result.RetryAfter != time.Second {
+			t.Errorf("atomic %t: expected to be limited for 1s but got %t, %s", atomic, limited, result.RetryAfter)
+		}
+
+		ts.clock = ts.clock.Add(time.Second)
+		if limited, _, err := rl.RateLimitCtx(ctx, "foo", 1); err != nil || limited {
+			t.Errorf("atomic %t: expected the key to recover under the smaller quota but got %t, %v", atomic, limited, err)
+		}
+	}
+}
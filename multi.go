@@ -0,0 +1,155 @@
+package throttled
+
+import (
+	"context"
+	"errors"
+	"strconv"
+)
+
+// MultiRateLimiterCtx is a RateLimiterCtx that enforces several
+// RateQuotas on each key at once, such as 10 requests per second and
+// 1000 requests per hour. A request is only counted against the quotas
+// if all of them permit it.
+//
+// Each quota is tracked with GCRA under its own key in the shared
+// store, made of the key followed by a colon and the index of the
+// quota, such as "user:42:0" and "user:42:1" for the key "user:42".
+//
+// The quotas are not updated atomically. A request is counted against
+// each quota in turn and given back if a later quota limits it, so
+// until it has been given back, concurrent requests for the same key
+// see that quota as more exhausted than it ends up being and may be
+// limited by it even though they would have been permitted had the
+// requests been made one after another. Requests are never permitted
+// beyond any of the quotas. Ordering quotas from the most to the least
+// restrictive makes this less likely.
+type MultiRateLimiterCtx struct {
+	limiters []*GCRARateLimiterCtx
+}
+
+// NewMultiRateLimiterCtx creates a MultiRateLimiterCtx enforcing all of
+// the given quotas, which follow the same rules as those passed to
+// NewGCRARateLimiterCtx. At least one quota must be given.
+func NewMultiRateLimiterCtx(st GCRAStoreCtx, quotas ...RateQuota) (*MultiRateLimiterCtx, error) {
+	if len(quotas) == 0 {
+		return nil, errors.New("at least one RateQuota is required")
+	}
+
+	limiters := make([]*GCRARateLimiterCtx, len(quotas))
+	for i, quota := range quotas {
+		l, err := NewGCRARateLimiterCtx(st, quota)
+		if err != nil {
+			return nil, err
+		}
+		limiters[i] = l
+	}
+
+	return &MultiRateLimiterCtx{limiters: limiters}, nil
+}
+
+// RateLimitCtx checks whether a particular key has exceeded any of the
+// quotas. It also returns a RateLimitResult reflecting the most
+// restrictive quota: Limit and Remaining are those of the quota with
+// the fewest requests remaining, while ResetAfter and RetryAfter are
+// the longest of all quotas.
+//
+// The quotas are evaluated in order. If one of them limits the
+// request, the quantity already counted against the ones before it is
+// given back, so a limited request doesn't count against any quota. If
+// quantity is 0, no update is performed allowing you to "peek" at the
+// state of the RateLimiter for a given key.
+func (m *MultiRateLimiterCtx) RateLimitCtx(ctx context.Context, key string, quantity int) (bool, RateLimitResult, error) {
+	results := make([]RateLimitResult, len(m.limiters))
+	reservations := make([]*Reservation, 0, len(m.limiters))
+
+	for i, l := range m.limiters {
+		limited, r, err := l.RateLimitReservationCtx(ctx, quotaKey(key, i), quantity)
+		if err != nil {
+			cancelReservations(ctx, reservations)
+			return false, RateLimitResult{}, err
+		}
+
+		if !limited {
+			reservations = append(reservations, r)
+			results[i] = r.Result()
+			continue
+		}
+
+		if err := cancelReservations(ctx, reservations); err != nil {
+			return false, RateLimitResult{}, err
+		}
+
+		// Report the state of the other quotas without this request and
+		// when each of them would permit it, as several may be exhausted
+		for j, other := range m.limiters {
+			if j == i {
+				results[j] = r.Result()
+				continue
+			}
+			results[j], err = other.PeekCtx(ctx, quotaKey(key, j), quantity)
+			if err != nil {
+				return false, RateLimitResult{}, err
+			}
+		}
+
+		return true, mergeResults(results), nil
+	}
+
+	return false, mergeResults(results), nil
+}
+
+// PeekCtx returns the state of the quotas for key without updating
+// them, merged like the results of RateLimitCtx, with RetryAfter set to
+// the time until quantity would be permitted by all of them, or -1 if
+// it would be permitted now or never.
+func (m *MultiRateLimiterCtx) PeekCtx(ctx context.Context, key string, quantity int) (RateLimitResult, error) {
+	results := make([]RateLimitResult, len(m.limiters))
+	never := false
+	for i, l := range m.limiters {
+		var err error
+		results[i], err = l.PeekCtx(ctx, quotaKey(key, i), quantity)
+		if err != nil {
+			return RateLimitResult{}, err
+		}
+		never = never || l.loadParams().exceedsBurst(quantity)
+	}
+
+	result := mergeResults(results)
+	if never {
+		result.RetryAfter = -1
+	}
+	return result, nil
+}
+
+func quotaKey(key string, i int) string {
+	return key + ":" + strconv.Itoa(i)
+}
+
+func cancelReservations(ctx context.Context, reservations []*Reservation) error {
+	var firstErr error
+	for _, r := range reservations {
+		if err := r.Cancel(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// mergeResults combines the results of several quotas into the result
+// of the most restrictive one.
+func mergeResults(results []RateLimitResult) RateLimitResult {
+	merged := results[0]
+	for _, r := range results[1:] {
+		if r.Remaining < merged.Remaining || r.Remaining == merged.Remaining && r.Limit < merged.Limit {
+			merged.Limit = r.Limit
+			merged.Remaining = r.Remaining
+		}
+		if r.ResetAfter > merged.ResetAfter {
+			merged.ResetAfter = r.ResetAfter
+		}
+		if r.RetryAfter > merged.RetryAfter {
+			merged.RetryAfter = r.RetryAfter
+		}
+	}
+	return merged
+}
@@ -0,0 +1,187 @@
+package throttled_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled/v2"
+	"github.com/throttled/throttled/v2/store/memstore"
+)
+
+func TestMultiRateLimit(t *testing.T) {
+	perSec := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 1}
+	perMin := throttled.RateQuota{MaxRate: throttled.PerMin(6), MaxBurst: 2}
+	start := time.Unix(0, 0)
+	cases := []struct {
+		now              time.Time
+		volume           int
+		limit, remaining int
+		reset, retry     time.Duration
+		limited          bool
+	}{
+		0: {start, 1, 2, 1, 10 * time.Second, -1, false},
+		1: {start, 1, 2, 0, 20 * time.Second, -1, false},
+		// Limited by the first quota
+		2: {start, 1, 2, 0, 20 * time.Second, time.Second, true},
+		3: {start.Add(2 * time.Second), 1, 3, 0, 28 * time.Second, -1, false},
+		// Limited by the second quota, which gives back the first
+		4: {start.Add(3 * time.Second), 1, 3, 0, 27 * time.Second, 7 * time.Second, true},
+	}
+
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := testStore{store: mst}
+
+	rl, err := throttled.NewMultiRateLimiterCtx(&st, perSec, perMin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range cases {
+		st.clock = c.now
+
+		limited, result, err := rl.RateLimitCtx(context.Background(), "foo", c.volume)
+		if err != nil {
+			t.Fatalf("%d: %#v", i, err)
+		}
+
+		if limited != c.limited {
+			t.Errorf("%d: expected Limited to be %t but got %t", i, c.limited, limited)
+		}
+
+		if have, want := result.Limit, c.limit; have != want {
+			t.Errorf("%d: expected Limit to be %d but got %d", i, want, have)
+		}
+
+		if have, want := result.Remaining, c.remaining; have != want {
+			t.Errorf("%d: expected Remaining to be %d but got %d", i, want, have)
+		}
+
+		if have, want := result.ResetAfter, c.reset; have != want {
+			t.Errorf("%d: expected ResetAfter to be %s but got %s", i, want, have)
+		}
+
+		if have, want := result.RetryAfter, c.retry; have != want {
+			t.Errorf("%d: expected RetryAfter to be %s but got %s", i, want, have)
+		}
+	}
+
+	// The first quota doesn't count the request limited by the second
+	single, err := throttled.NewGCRARateLimiterCtx(&st, perSec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, result, err := single.RateLimitCtx(context.Background(), "foo:0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := result.Remaining, 2; have != want {
+		t.Errorf("expected Remaining of the first quota to be %d but got %d", want, have)
+	}
+}
+
+func TestMultiRateLimitRetryAfter(t *testing.T) {
+	perSec := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 0}
+	perHour := throttled.RateQuota{MaxRate: throttled.PerHour(1), MaxBurst: 0}
+
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := testStore{store: mst, clock: time.Unix(0, 0)}
+
+	rl, err := throttled.NewMultiRateLimiterCtx(&st, perSec, perHour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if limited, _, err := rl.RateLimitCtx(context.Background(), "foo", 1); err != nil || limited {
+		t.Fatalf("expected the first request to be permitted but got %t, %v", limited, err)
+	}
+
+	// Both quotas are exhausted, and the request is only permitted once
+	// the hourly one permits it
+	limited, result, err := rl.RateLimitCtx(context.Background(), "foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !limited {
+		t.Error("expected the second request to be limited")
+	}
+	if have, want := result.RetryAfter, time.Hour; have != want {
+		t.Errorf("expected RetryAfter to be %s but got %s", want, have)
+	}
+}
+
+func TestMultiRateLimitConcurrent(t *testing.T) {
+	loose := throttled.RateQuota{MaxRate: throttled.PerHour(1), MaxBurst: 4}
+	tight := throttled.RateQuota{MaxRate: throttled.PerHour(1), MaxBurst: 2}
+
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &atomicTestStore{testStore: &testStore{store: mst, clock: time.Unix(0, 0)}}
+
+	rl, err := throttled.NewMultiRateLimiterCtx(st, loose, tight)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	permitted := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limited, _, err := rl.RateLimitCtx(context.Background(), "foo", 1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !limited {
+				mu.Lock()
+				permitted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Concurrent requests may be limited spuriously while others are
+	// given back, but never permitted beyond a quota
+	if permitted < 1 || permitted > 3 {
+		t.Errorf("expected 1 to 3 requests to be permitted but got %d", permitted)
+	}
+
+	// Only the permitted requests remain counted against the first quota
+	first, err := throttled.NewGCRARateLimiterCtx(st, loose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := first.PeekCtx(context.Background(), "foo:0", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := result.Remaining, 5-permitted; have != want {
+		t.Errorf("expected %d requests to remain in the first quota but got %d", want, have)
+	}
+}
+
+func TestMultiRateLimitInvalid(t *testing.T) {
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := throttled.NewMultiRateLimiterCtx(mst); err == nil {
+		t.Error("expected creating a limiter without quotas to fail")
+	}
+	if _, err := throttled.NewMultiRateLimiterCtx(mst, throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: -1}); err == nil {
+		t.Error("expected creating a limiter with an invalid quota to fail")
+	}
+}
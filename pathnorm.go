@@ -0,0 +1,102 @@
+package throttled
+
+import (
+	"regexp"
+	"strings"
+)
+
+// PathNormalizer normalizes request paths so that the paths of all
+// requests to a route produce the same key, for example to limit all
+// requests to /users/{id} together rather than per user.
+//
+// Paths are normalized by first applying TrimTrailingSlash and
+// IgnoreCase. The path is then replaced by the first template it
+// matches or, if it matches none, rewritten by each rewrite in turn.
+type PathNormalizer struct {
+	// Templates are route templates such as /users/{id}/posts. A
+	// segment in braces matches any single non-empty segment, and a
+	// final segment like {rest...} matches one or more segments. Other
+	// segments must match exactly, or regardless of case if IgnoreCase
+	// is set.
+	Templates []string
+
+	// Rewrites are applied in order to paths that don't match any of the
+	// templates.
+	Rewrites []PathRewrite
+
+	// TrimTrailingSlash removes a trailing slash from paths other than
+	// the root path.
+	TrimTrailingSlash bool
+
+	// IgnoreCase converts paths to lower case.
+	IgnoreCase bool
+}
+
+// PathRewrite replaces all matches of Pattern in a path with
+// Replacement, which can refer to submatches as described by
+// regexp.Regexp.ReplaceAllString.
+type PathRewrite struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// Normalize returns the normalized form of path.
+func (n *PathNormalizer) Normalize(path string) string {
+	if n == nil {
+		return path
+	}
+
+	if n.TrimTrailingSlash && len(path) > 1 {
+		path = strings.TrimRight(path, "/")
+		if path == "" {
+			path = "/"
+		}
+	}
+	if n.IgnoreCase {
+		path = strings.ToLower(path)
+	}
+
+	for _, tmpl := range n.Templates {
+		if matchPathTemplate(tmpl, path, n.IgnoreCase) {
+			return tmpl
+		}
+	}
+
+	for _, rw := range n.Rewrites {
+		path = rw.Pattern.ReplaceAllString(path, rw.Replacement)
+	}
+	return path
+}
+
+// matchPathTemplate reports whether path matches the route template
+// tmpl.
+func matchPathTemplate(tmpl, path string, ignoreCase bool) bool {
+	tmplSegs := strings.Split(tmpl, "/")
+	pathSegs := strings.Split(path, "/")
+
+	for i, seg := range tmplSegs {
+		isParam := len(seg) > 2 && seg[0] == '{' && seg[len(seg)-1] == '}'
+		if i >= len(pathSegs) {
+			return false
+		}
+		if isParam && i == len(tmplSegs)-1 && strings.HasSuffix(seg, "...}") {
+			return pathSegs[i] != ""
+		}
+
+		switch {
+		case isParam:
+			if pathSegs[i] == "" {
+				return false
+			}
+		case ignoreCase:
+			if !strings.EqualFold(seg, pathSegs[i]) {
+				return false
+			}
+		default:
+			if seg != pathSegs[i] {
+				return false
+			}
+		}
+	}
+	return len(tmplSegs) == len(pathSegs)
+}
@@ -0,0 +1,48 @@
+package throttled_test
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/throttled/throttled/v2"
+)
+
+func TestPathNormalizer(t *testing.T) {
+	n := &throttled.PathNormalizer{
+		Templates: []string{
+			"/users/{id}",
+			"/users/{id}/posts/{post}",
+			"/Files/{path...}",
+		},
+		Rewrites: []throttled.PathRewrite{
+			{Pattern: regexp.MustCompile(`/[0-9]+(/|$)`), Replacement: "/:num$1"},
+			{Pattern: regexp.MustCompile(`^/v[0-9]+/`), Replacement: "/"},
+		},
+		TrimTrailingSlash: true,
+		IgnoreCase:        true,
+	}
+
+	for i, c := range []struct {
+		path, want string
+	}{
+		0: {"/users/123", "/users/{id}"},
+		1: {"/Users/456/", "/users/{id}"},
+		2: {"/users/123/posts/7", "/users/{id}/posts/{post}"},
+		3: {"/users//posts/7", "/users//posts/:num"},
+		4: {"/users", "/users"},
+		5: {"/files/a/b/c.txt", "/Files/{path...}"},
+		6: {"/files/", "/files"},
+		7: {"/v2/orders/42/items/9", "/orders/:num/items/:num"},
+		8: {"///", "/"},
+		9: {"/", "/"},
+	} {
+		if have := n.Normalize(c.path); have != c.want {
+			t.Errorf("%d: expected %s to be normalized to %s but got %s", i, c.path, c.want, have)
+		}
+	}
+
+	var none *throttled.PathNormalizer
+	if have := none.Normalize("/Users/1/"); have != "/Users/1/" {
+		t.Errorf("expected a nil normalizer to keep the path but got %s", have)
+	}
+}
@@ -0,0 +1,130 @@
+package throttled
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// PolicyRoute applies the policy implemented by Limiter to the requests
+// matching a method, host and path.
+type PolicyRoute struct {
+	// Method is the HTTP method of matching requests. If it is empty,
+	// requests with any method match.
+	Method string
+
+	// Host is the host of matching requests, without a port. A host
+	// starting with "*.", such as "*.example.com", matches all of its
+	// subdomains. If it is empty, requests to any host match.
+	Host string
+
+	// Path is the URL path of matching requests. It may be a template
+	// like /users/{id} as described by PathNormalizer. A path ending in
+	// a slash, such as "/export/", matches all paths it is a prefix of,
+	// like the patterns of http.ServeMux. If it is empty, requests with
+	// any path match.
+	Path string
+
+	// Limiter rate limits the matching requests. Its Name is reported
+	// in the RateLimitInfo of requests it made the decision for.
+	Limiter *HTTPRateLimiterCtx
+}
+
+func (pr *PolicyRoute) matches(r *http.Request) bool {
+	if pr.Method != "" && pr.Method != r.Method {
+		return false
+	}
+	if pr.Host != "" && !matchHost(pr.Host, r.Host) {
+		return false
+	}
+	if pr.Path == "" || pr.Path == r.URL.Path {
+		return true
+	}
+	if strings.HasSuffix(pr.Path, "/") {
+		return strings.HasPrefix(r.URL.Path, pr.Path)
+	}
+	return strings.Contains(pr.Path, "{") && matchPathTemplate(pr.Path, r.URL.Path, false)
+}
+
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := pattern[1:]
+		return len(host) > len(suffix) && strings.EqualFold(host[len(host)-len(suffix):], suffix)
+	}
+	return strings.EqualFold(pattern, host)
+}
+
+// PolicyMux applies different rate limiting policies to requests based
+// on their method, host and path, for example to limit logins more
+// strictly than searches:
+//
+//	mux := throttled.PolicyMux{
+//		Global: []*throttled.HTTPRateLimiterCtx{perIP},
+//		Routes: []throttled.PolicyRoute{
+//			{Method: "POST", Path: "/login", Limiter: login},
+//			{Path: "/search", Limiter: search},
+//			{Path: "/export/", Limiter: export},
+//		},
+//		Default: api,
+//	}
+//	http.ListenAndServe(":8080", mux.RateLimit(handler))
+//
+// Each policy is an HTTPRateLimiterCtx with its own RateLimiter, VaryBy,
+// Cost and DeniedHandler. Its Name identifies it in the RateLimitInfo
+// stored in the request context, which tells the handlers which policy
+// made the decision.
+//
+// The fields of a PolicyMux must not be modified after RateLimit has
+// been called.
+type PolicyMux struct {
+	// Global policies are applied to all requests in order, before the
+	// policy of their route. A request is only passed on to the route
+	// if all of them permit it, and is counted by them even if its
+	// route then denies it.
+	Global []*HTTPRateLimiterCtx
+
+	// Routes are matched against each request in order and the policy
+	// of the first matching route is applied to it.
+	Routes []PolicyRoute
+
+	// Default is applied to requests that don't match any route. If it
+	// is nil, these requests are only limited by the Global policies.
+	Default *HTTPRateLimiterCtx
+}
+
+// RateLimit wraps an http.Handler to limit incoming requests according
+// to the policies of the PolicyMux. Requests that are permitted by all
+// applicable policies will be passed to the handler unchanged. Limited
+// requests will be passed to the DeniedHandler of the policy that
+// limited them.
+func (m *PolicyMux) RateLimit(h http.Handler) http.Handler {
+	routes := make([]http.Handler, len(m.Routes))
+	for i, route := range m.Routes {
+		routes[i] = m.stack(route.Limiter, h)
+	}
+	def := m.stack(m.Default, h)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := range m.Routes {
+			if m.Routes[i].matches(r) {
+				routes[i].ServeHTTP(w, r)
+				return
+			}
+		}
+		def.ServeHTTP(w, r)
+	})
+}
+
+// stack wraps h in the route policy, if any, and the Global policies.
+func (m *PolicyMux) stack(route *HTTPRateLimiterCtx, h http.Handler) http.Handler {
+	if route != nil {
+		h = route.RateLimit(h)
+	}
+	for i := len(m.Global) - 1; i >= 0; i-- {
+		h = m.Global[i].RateLimit(h)
+	}
+	return h
+}
@@ -0,0 +1,87 @@
+package throttled_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled/v2"
+	"github.com/throttled/throttled/v2/store/memstore"
+)
+
+func newPolicy(t *testing.T, name string, burst int) *throttled.HTTPRateLimiterCtx {
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: burst}
+	rl, err := throttled.NewGCRARateLimiterCtx(&testStore{store: mst, clock: time.Unix(0, 0)}, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &throttled.HTTPRateLimiterCtx{Name: name, RateLimiter: rl}
+}
+
+func TestPolicyMux(t *testing.T) {
+	var policy string
+	record := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, _ := throttled.RateLimitInfoFromContext(r.Context())
+		policy = info.Policy
+		if info.Limited {
+			w.WriteHeader(429)
+		}
+	})
+
+	mux := throttled.PolicyMux{
+		Global: []*throttled.HTTPRateLimiterCtx{newPolicy(t, "global", 7)},
+		Routes: []throttled.PolicyRoute{
+			{Method: "POST", Path: "/login", Limiter: newPolicy(t, "login", 0)},
+			{Host: "*.example.com", Path: "/users/{id}", Limiter: newPolicy(t, "users", 1)},
+			{Path: "/static/"},
+		},
+		Default: newPolicy(t, "default", 10),
+	}
+	for _, l := range append(mux.Global, mux.Routes[0].Limiter, mux.Routes[1].Limiter, mux.Default) {
+		l.DeniedHandler = record
+	}
+	handler := mux.RateLimit(record)
+
+	// The headers describe the most restrictive of the policies applied
+	for i, c := range []struct {
+		method, url      string
+		code             int
+		policy           string
+		limit, remaining string
+	}{
+		0: {"POST", "http://example.com/login", 200, "login", "1", "0"},
+		1: {"POST", "http://example.com/login", 429, "login", "1", "0"},
+		2: {"GET", "http://example.com/login", 200, "default", "8", "5"},
+		3: {"GET", "http://api.example.com:8080/users/1", 200, "users", "2", "1"},
+		4: {"GET", "http://api.EXAMPLE.com/users/2", 200, "users", "2", "0"},
+		5: {"GET", "http://api.example.com/users/3", 429, "users", "2", "0"},
+		6: {"GET", "http://example.com/users/1", 200, "default", "8", "1"},
+		7: {"GET", "http://example.com/static/app.js", 200, "global", "8", "0"},
+		8: {"GET", "http://example.com/", 429, "global", "8", "0"},
+	} {
+		policy = ""
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(c.method, c.url, nil))
+		if rr.Code != c.code {
+			t.Errorf("%d: expected status %d but got %d", i, c.code, rr.Code)
+		}
+		if policy != c.policy {
+			t.Errorf("%d: expected policy %s but got %s", i, c.policy, policy)
+		}
+		for name, want := range map[string]string{"X-Ratelimit-Limit": c.limit, "X-Ratelimit-Remaining": c.remaining} {
+			if have := rr.Header()[name]; len(have) != 1 || have[0] != want {
+				t.Errorf("%d: expected %s to be [%s] but got %v", i, name, want, have)
+			}
+		}
+		if c.code == 429 {
+			if have := rr.Header()["Retry-After"]; len(have) != 1 || have[0] != "60" {
+				t.Errorf("%d: expected Retry-After to be [60] but got %v", i, have)
+			}
+		}
+	}
+}
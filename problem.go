@@ -0,0 +1,172 @@
+package throttled
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const problemContentType = "application/problem+json"
+
+// ProblemDeniedHandler is a DeniedHandler that responds with a 429
+// status code and an RFC 7807 application/problem+json body describing
+// the limit that was exceeded, for example:
+//
+//	{
+//	  "type": "about:blank",
+//	  "title": "Too Many Requests",
+//	  "status": 429,
+//	  "detail": "Rate limit exceeded, retry after 60 seconds.",
+//	  "limit": 10,
+//	  "remaining": 0,
+//	  "retry_after": 60,
+//	  "scope": "user"
+//	}
+//
+// Clients that prefer text/plain or text/html over JSON in their
+// Accept header get the detail as plain text instead. The limit,
+// remaining and retry_after members are taken from the RateLimitResult
+// stored in the request context by HTTPRateLimiterCtx and omitted if
+// it is not available or they are not relevant.
+type ProblemDeniedHandler struct {
+	// Type is a URI identifying the type of problem. If it is empty,
+	// "about:blank" is used.
+	Type string
+
+	// Scope describes what the limit applies to, such as "ip" or
+	// "user", without disclosing the key itself. It is omitted from the
+	// body if it is empty.
+	Scope string
+}
+
+type problem struct {
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	Status     int    `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+	Limit      *int   `json:"limit,omitempty"`
+	Remaining  *int   `json:"remaining,omitempty"`
+	RetryAfter *int   `json:"retry_after,omitempty"`
+	Scope      string `json:"scope,omitempty"`
+}
+
+// ServeHTTP writes the problem details of a limited request to w.
+func (h ProblemDeniedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := problem{
+		Type:   h.Type,
+		Title:  http.StatusText(http.StatusTooManyRequests),
+		Status: http.StatusTooManyRequests,
+		Detail: "Rate limit exceeded.",
+		Scope:  h.Scope,
+	}
+
+	if result, ok := RateLimitResultFromContext(r.Context()); ok {
+		if result.Limit >= 0 {
+			p.Limit = &result.Limit
+		}
+		if result.Remaining >= 0 {
+			p.Remaining = &result.Remaining
+		}
+		if result.RetryAfter >= 0 {
+			retryAfter := ceilSeconds(result.RetryAfter)
+			p.RetryAfter = &retryAfter
+			p.Detail = "Rate limit exceeded, retry after " + strconv.Itoa(retryAfter) + " seconds."
+		}
+	}
+
+	writeProblem(w, r, p)
+}
+
+// ProblemError is an Error function for HTTPRateLimiterCtx that
+// responds with a 500 status code and an RFC 7807
+// application/problem+json body, or plain text for clients that prefer
+// it like ProblemDeniedHandler. The error itself is not disclosed.
+func ProblemError(w http.ResponseWriter, r *http.Request, err error) {
+	writeProblem(w, r, problem{
+		Title:  http.StatusText(http.StatusInternalServerError),
+		Status: http.StatusInternalServerError,
+		Detail: "The rate limit could not be checked.",
+	})
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, p problem) {
+	if !prefersJSON(r.Header.Get("Accept")) {
+		http.Error(w, p.Detail, p.Status)
+		return
+	}
+
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		http.Error(w, p.Detail, p.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	w.Write(body)
+}
+
+// prefersJSON reports whether a client sending the given Accept header
+// prefers a JSON body to a text body. JSON is used unless a text type
+// has a higher quality than all JSON types.
+func prefersJSON(accept string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+
+	jsonQ := maxFloat(acceptQuality(accept, problemContentType), acceptQuality(accept, "application/json"))
+	textQ := maxFloat(acceptQuality(accept, "text/plain"), acceptQuality(accept, "text/html"))
+	return jsonQ >= textQ
+}
+
+// acceptQuality returns the quality an Accept header assigns to the
+// media type offer, using the most specific matching media range.
+func acceptQuality(accept, offer string) float64 {
+	offerType := offer[:strings.IndexByte(offer, '/')]
+
+	q, specificity := 0.0, 0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+
+		var s int
+		switch mediaRange {
+		case offer:
+			s = 3
+		case offerType + "/*":
+			s = 2
+		case "*/*":
+			s = 1
+		default:
+			continue
+		}
+		if s <= specificity {
+			continue
+		}
+
+		specificity = s
+		q = 1
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+	}
+	return q
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,145 @@
+package throttled_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled/v2"
+	"github.com/throttled/throttled/v2/store/memstore"
+)
+
+func TestProblemDeniedHandler(t *testing.T) {
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 1}
+	rl, err := throttled.NewGCRARateLimiterCtx(&testStore{store: mst, clock: time.Unix(0, 0)}, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := throttled.HTTPRateLimiterCtx{
+		RateLimiter:   rl,
+		DeniedHandler: throttled.ProblemDeniedHandler{Scope: "user"},
+		Error:         throttled.ProblemError,
+	}
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	for i := 0; i < 2; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if have, want := rr.Code, 429; have != want {
+		t.Errorf("expected status %d but got %d", want, have)
+	}
+	if have, want := rr.Header().Get("Content-Type"), "application/problem+json"; have != want {
+		t.Errorf("expected Content-Type %s but got %s", want, have)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"type":        "about:blank",
+		"title":       "Too Many Requests",
+		"status":      429.0,
+		"detail":      "Rate limit exceeded, retry after 60 seconds.",
+		"limit":       2.0,
+		"remaining":   0.0,
+		"retry_after": 60.0,
+		"scope":       "user",
+	}
+	for k, v := range want {
+		if body[k] != v {
+			t.Errorf("expected %s to be %v but got %v", k, v, body[k])
+		}
+	}
+	if len(body) != len(want) {
+		t.Errorf("expected %d members but got %v", len(want), body)
+	}
+}
+
+func TestProblemContentNegotiation(t *testing.T) {
+	limiter := throttled.HTTPRateLimiterCtx{
+		RateLimiter:   &stubLimiter{},
+		VaryBy:        &pathGetter{},
+		DeniedHandler: throttled.ProblemDeniedHandler{Type: "https://example.com/rate-limit"},
+		Error:         throttled.ProblemError,
+	}
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	for i, c := range []struct {
+		path, accept string
+		code         int
+		contentType  string
+		body         string
+	}{
+		0: {"limit", "", 429, "application/problem+json", `"type":"https://example.com/rate-limit"`},
+		1: {"limit", "*/*", 429, "application/problem+json", `"retry_after":60`},
+		2: {"limit", "text/html,application/xhtml+xml,*/*;q=0.8", 429, "text/plain; charset=utf-8", "Rate limit exceeded, retry after 60 seconds."},
+		3: {"limit", "text/plain;q=0.5, application/*", 429, "application/problem+json", `"status":429`},
+		4: {"limit", "application/json;q=0.2, text/*;q=0.3", 429, "text/plain; charset=utf-8", "Rate limit exceeded"},
+		5: {"error", "application/problem+json", 500, "application/problem+json", `"title":"Internal Server Error"`},
+		6: {"error", "text/plain", 500, "text/plain; charset=utf-8", "The rate limit could not be checked."},
+	} {
+		req, err := http.NewRequest("GET", c.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.accept != "" {
+			req.Header.Set("Accept", c.accept)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if have, want := rr.Code, c.code; have != want {
+			t.Errorf("%d: expected status %d but got %d", i, want, have)
+		}
+		if have, want := rr.Header().Get("Content-Type"), c.contentType; have != want {
+			t.Errorf("%d: expected Content-Type %s but got %s", i, want, have)
+		}
+		if body := rr.Body.String(); !strings.Contains(body, c.body) {
+			t.Errorf("%d: expected body to contain %s but got %s", i, c.body, body)
+		}
+	}
+}
+
+func TestRateLimitResultFromContext(t *testing.T) {
+	var result throttled.RateLimitResult
+	var ok bool
+	limiter := throttled.HTTPRateLimiterCtx{
+		RateLimiter: &stubLimiter{},
+		VaryBy:      &pathGetter{},
+		DeniedHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result, ok = throttled.RateLimitResultFromContext(r.Context())
+		}),
+	}
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req, err := http.NewRequest("GET", "limit", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !ok {
+		t.Fatal("expected the result to be available to the DeniedHandler")
+	}
+	if have, want := result.RetryAfter, time.Minute; have != want {
+		t.Errorf("expected RetryAfter to be %s but got %s", want, have)
+	}
+}
@@ -2,7 +2,10 @@ package throttled
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,6 +30,21 @@ type RateLimiterCtx interface {
 	RateLimitCtx(ctx context.Context, key string, quantity int) (bool, RateLimitResult, error)
 }
 
+// ErrPeekNotSupported is returned by the limiters wrapping other
+// limiters when peeking at a limiter that doesn't implement Peeker.
+var ErrPeekNotSupported = errors.New("rate limiter doesn't support peeking")
+
+// A Peeker is a RateLimiterCtx that can tell when a quantity would be
+// permitted for a key without counting it, for example to tell clients
+// when to retry. Limiters wrapping other limiters implement it by
+// forwarding to them.
+type Peeker interface {
+	// PeekCtx returns the state of the RateLimiter for key without
+	// updating it, with RetryAfter set to the time until quantity would
+	// be permitted, or to -1 if it would be permitted now or never.
+	PeekCtx(ctx context.Context, key string, quantity int) (RateLimitResult, error)
+}
+
 // RateLimitResult represents the state of the RateLimiter for a
 // given key at the time of the query. This state can be used, for
 // example, to communicate information to the client via HTTP
@@ -80,7 +98,8 @@ func (r *rateLimitResult) RetryAfter() time.Duration { return r.retryAfter }
 // allowed per minute.
 type Rate struct {
 	period time.Duration // Time between equally spaced requests at the rate
-	count  int           // Used internally for deprecated `RateLimit` interface only
+	count  int           // Requests per window, for window based limiters and the deprecated `RateLimit` interface
+	window time.Duration // Duration of the window, which period*count may fall short of after rounding
 }
 
 // RateQuota describes the number of requests allowed per time period.
@@ -103,25 +122,60 @@ type RateQuota struct {
 }
 
 // PerSec represents a number of requests per second.
-func PerSec(n int) Rate { return Rate{time.Second / time.Duration(n), n} }
+func PerSec(n int) Rate { return PerDuration(n, time.Second) }
 
 // PerMin represents a number of requests per minute.
-func PerMin(n int) Rate { return Rate{time.Minute / time.Duration(n), n} }
+func PerMin(n int) Rate { return PerDuration(n, time.Minute) }
 
 // PerHour represents a number of requests per hour.
-func PerHour(n int) Rate { return Rate{time.Hour / time.Duration(n), n} }
+func PerHour(n int) Rate { return PerDuration(n, time.Hour) }
 
 // PerDay represents a number of requests per day.
-func PerDay(n int) Rate { return Rate{24 * time.Hour / time.Duration(n), n} }
+func PerDay(n int) Rate { return PerDuration(n, 24*time.Hour) }
 
 // PerDuration represents a number of requests per provided duration.
-func PerDuration(n int, d time.Duration) Rate { return Rate{d / time.Duration(n), n} }
+func PerDuration(n int, d time.Duration) Rate { return Rate{d / time.Duration(n), n, d} }
 
 // GCRARateLimiterCtx is a RateLimiter that uses the generic cell-rate
 // algorithm. The algorithm has been slightly modified from its usual
 // form to support limiting with an additional quantity parameter, such
 // as for limiting the number of bytes uploaded.
 type GCRARateLimiterCtx struct {
+	// params holds the *gcraParams derived from the current quota. It
+	// is replaced as a whole by UpdateQuota.
+	params atomic.Value
+
+	store GCRAStoreCtx
+
+	// atomicStore is set when store can evaluate updates atomically, in
+	// which case it is used instead of the compare-and-swap loop.
+	atomicStore GCRAStoreAtomicCtx
+
+	// Maximum number of times to retry SetIfNotExists/CompareAndSwap operations
+	// before returning an error.
+	maxCASAttemptsLimit int
+}
+
+type gcraParams struct {
+	// After the tolerance has been reduced by UpdateQuota, stored
+	// theoretical arrival times may lie further in the future than the
+	// new tolerance permits. For the duration of transition, which is
+	// the largest tolerance previously in effect, such times are
+	// clamped to the new tolerance. transitionEnd is the UnixNano time
+	// at which this stops, set by the first call to observe the time
+	// of the store, and transitionDone is set once it has passed.
+	// transitionEnd is accessed atomically and must stay 64-bit aligned.
+	transitionEnd  int64
+	transitionDone int32
+	transition     time.Duration
+
+	// clampAlways is set when state may be written under a larger
+	// tolerance at any time, such as by a KeyedGCRARateLimiterCtx with a
+	// larger quota sharing the store, in which case stored theoretical
+	// arrival times are clamped for as long as the limiter is in use.
+	clampAlways bool
+
+	quota RateQuota
 	limit int
 
 	// Think of the DVT as our flexibility:
@@ -133,12 +187,54 @@ type GCRARateLimiterCtx struct {
 	// in the nominal equally spaced schedule. If you like leaky buckets,
 	// think of it as how frequently the bucket leaks one unit.
 	emissionInterval time.Duration
+}
 
-	store GCRAStoreCtx
+func newGCRAParams(quota RateQuota) (*gcraParams, error) {
+	if quota.MaxBurst < 0 {
+		return nil, fmt.Errorf("invalid RateQuota %#v; MaxBurst must be greater than zero", quota)
+	}
+	if quota.MaxRate.period <= 0 {
+		return nil, fmt.Errorf("invalid RateQuota %#v; MaxRate must be greater than zero", quota)
+	}
 
-	// Maximum number of times to retry SetIfNotExists/CompareAndSwap operations
-	// before returning an error.
-	maxCASAttemptsLimit int
+	return &gcraParams{
+		delayVariationTolerance: quota.MaxRate.period * (time.Duration(quota.MaxBurst) + 1),
+		emissionInterval:        quota.MaxRate.period,
+		quota:                   quota,
+		limit:                   quota.MaxBurst + 1,
+	}, nil
+}
+
+// exceedsBurst reports whether quantity is more than can ever be
+// admitted at once.
+func (p *gcraParams) exceedsBurst(quantity int) bool {
+	return time.Duration(quantity) > p.delayVariationTolerance/p.emissionInterval
+}
+
+// clamping reports whether stored theoretical arrival times may still
+// need to be clamped after a reduction of the tolerance.
+func (p *gcraParams) clamping() bool {
+	if p.clampAlways {
+		return true
+	}
+	return p.transition > 0 && atomic.LoadInt32(&p.transitionDone) == 0
+}
+
+// inTransition reports whether stored theoretical arrival times should
+// be clamped at the store time now.
+func (p *gcraParams) inTransition(now time.Time) bool {
+	if !p.clamping() {
+		return false
+	}
+	if p.clampAlways {
+		return true
+	}
+	atomic.CompareAndSwapInt64(&p.transitionEnd, 0, now.Add(p.transition).UnixNano())
+	if now.UnixNano() < atomic.LoadInt64(&p.transitionEnd) {
+		return true
+	}
+	atomic.StoreInt32(&p.transitionDone, 1)
+	return false
 }
 
 // NewGCRARateLimiterCtx creates a GCRARateLimiterCtx. quota.Count defines
@@ -148,20 +244,83 @@ type GCRARateLimiterCtx struct {
 // followed by one request per second indefinitely whereas PerSec(1)
 // only permits one request per second with no tolerance for bursts.
 func NewGCRARateLimiterCtx(st GCRAStoreCtx, quota RateQuota) (*GCRARateLimiterCtx, error) {
-	if quota.MaxBurst < 0 {
-		return nil, fmt.Errorf("invalid RateQuota %#v; MaxBurst must be greater than zero", quota)
+	params, err := newGCRAParams(quota)
+	if err != nil {
+		return nil, err
 	}
-	if quota.MaxRate.period <= 0 {
-		return nil, fmt.Errorf("invalid RateQuota %#v; MaxRate must be greater than zero", quota)
+
+	atomicStore, _ := st.(GCRAStoreAtomicCtx)
+
+	g := &GCRARateLimiterCtx{
+		store:               st,
+		atomicStore:         atomicStore,
+		maxCASAttemptsLimit: maxCASAttempts,
 	}
+	g.params.Store(params)
+	return g, nil
+}
 
-	return &GCRARateLimiterCtx{
-		delayVariationTolerance: quota.MaxRate.period * (time.Duration(quota.MaxBurst) + 1),
-		emissionInterval:        quota.MaxRate.period,
-		limit:                   quota.MaxBurst + 1,
-		store:                   st,
-		maxCASAttemptsLimit:     maxCASAttempts,
-	}, nil
+// UpdateQuota atomically replaces the quota enforced by the limiter
+// for all subsequent calls, following the same rules as the quota
+// passed to NewGCRARateLimiterCtx. Calls already in progress complete
+// under the previous quota.
+//
+// The state stored for each key records how far ahead of its schedule
+// the key is, as a duration. That duration carries over unchanged, so
+// the time until a key returns to its initial state is the same under
+// the new quota and a key that was idle gets the full burst of the new
+// quota. If the burst is reduced, a key that was further ahead than
+// the new quota tolerates is treated as having just exhausted the new
+// burst rather than being locked out for the rest of its old schedule.
+// This applies for as long as state written under the old quota can
+// exist, which is the maximum burst duration of the old quota, and
+// uses compare-and-swap even when the store supports atomic updates.
+func (g *GCRARateLimiterCtx) UpdateQuota(quota RateQuota) error {
+	params, err := newGCRAParams(quota)
+	if err != nil {
+		return err
+	}
+
+	old := g.loadParams()
+	transition := old.delayVariationTolerance
+	if old.transition > transition {
+		transition = old.transition
+	}
+	if transition > params.delayVariationTolerance {
+		params.transition = transition
+	}
+
+	g.params.Store(params)
+	return nil
+}
+
+// clampAlways makes the limiter clamp stored theoretical arrival times
+// to its tolerance from now on, as it does during the transition after
+// UpdateQuota reduces the burst.
+func (g *GCRARateLimiterCtx) clampAlways() {
+	old := g.loadParams()
+	if old.clampAlways {
+		return
+	}
+	params := &gcraParams{
+		transition:              old.transition,
+		clampAlways:             true,
+		quota:                   old.quota,
+		limit:                   old.limit,
+		delayVariationTolerance: old.delayVariationTolerance,
+		emissionInterval:        old.emissionInterval,
+	}
+	g.params.Store(params)
+}
+
+// QuotaCtx returns the quota currently enforced by the limiter, which
+// is the same for all keys.
+func (g *GCRARateLimiterCtx) QuotaCtx(_ context.Context, _ string) (RateQuota, error) {
+	return g.loadParams().quota, nil
+}
+
+func (g *GCRARateLimiterCtx) loadParams() *gcraParams {
+	return g.params.Load().(*gcraParams)
 }
 
 // SetMaxCASAttemptsLimit allows you to set the maxCASAttempts limit. This is set to 10
@@ -181,10 +340,80 @@ func (g *GCRARateLimiterCtx) SetMaxCASAttemptsLimit(limit int) {
 // megabytes. If quantity is 0, no update is performed allowing you
 // to "peek" at the state of the RateLimiter for a given key.
 func (g *GCRARateLimiterCtx) RateLimitCtx(ctx context.Context, key string, quantity int) (bool, RateLimitResult, error) {
-	var tat, newTat, now time.Time
+	limited, rlc, _, err := g.rateLimit(ctx, key, quantity, 0)
+	return limited, rlc, err
+}
+
+// PeekCtx returns the state of key without updating it, with RetryAfter
+// set to the time until quantity would be permitted, or -1 if it would
+// be permitted now or never.
+func (g *GCRARateLimiterCtx) PeekCtx(ctx context.Context, key string, quantity int) (RateLimitResult, error) {
+	p := g.loadParams()
+	rlc, err := g.state(ctx, p, key)
+	if err != nil || p.exceedsBurst(quantity) {
+		return rlc, err
+	}
+	if wait := rlc.ResetAfter + time.Duration(quantity)*p.emissionInterval - p.delayVariationTolerance; wait > 0 {
+		rlc.RetryAfter = wait
+	}
+	return rlc, nil
+}
+
+// state returns the state of key under p, reading it from the store
+// without ever writing to it. RetryAfter is -1.
+func (g *GCRARateLimiterCtx) state(ctx context.Context, p *gcraParams, key string) (RateLimitResult, error) {
+	rlc := RateLimitResult{Limit: p.limit, RetryAfter: -1}
+
+	tatVal, now, err := g.store.GetWithTime(ctx, key)
+	if err != nil {
+		return rlc, err
+	}
+
 	var ttl time.Duration
-	rlc := RateLimitResult{Limit: g.limit, RetryAfter: -1}
-	limited := false
+	if tatVal != -1 {
+		tat := time.Unix(0, tatVal)
+		if maxTat := now.Add(p.delayVariationTolerance); tat.After(maxTat) && p.inTransition(now) {
+			tat = maxTat
+		}
+		if tat.After(now) {
+			ttl = tat.Sub(now)
+		}
+	}
+
+	next := p.delayVariationTolerance - ttl
+	if next > -p.emissionInterval {
+		rlc.Remaining = int(next / p.emissionInterval)
+	}
+	rlc.ResetAfter = ttl
+	return rlc, nil
+}
+
+// rateLimit implements RateLimitCtx. A request that would only conform
+// to the schedule after waiting is admitted if the wait does not exceed
+// maxDelay, in which case the required wait is returned along with the
+// result. A maxDelay of 0 gives the usual RateLimitCtx behavior.
+func (g *GCRARateLimiterCtx) rateLimit(ctx context.Context, key string, quantity int, maxDelay time.Duration) (bool, RateLimitResult, time.Duration, error) {
+	var tat, newTat, now time.Time
+	var ttl, delay time.Duration
+	p := g.loadParams()
+	rlc := RateLimitResult{Limit: p.limit, RetryAfter: -1}
+	var limited bool
+
+	// A quantity larger than the burst can never conform, and multiplying
+	// a huge one by the emission interval would overflow, so only peek at
+	// the state of the key
+	if p.exceedsBurst(quantity) {
+		rlc, err := g.state(ctx, p, key)
+		return true, rlc, 0, err
+	}
+
+	increment := time.Duration(quantity) * p.emissionInterval
+
+	// Stored state may need to be clamped, which the atomic store can't do
+	atomicStore := g.atomicStore
+	if p.clamping() {
+		atomicStore = nil
+	}
 
 	i := 0
 	for {
@@ -194,9 +423,18 @@ func (g *GCRARateLimiterCtx) RateLimitCtx(ctx context.Context, key string, quant
 
 		// tat refers to the theoretical arrival time that would be expected
 		// from equally spaced requests at exactly the rate limit.
-		tatVal, now, err = g.store.GetWithTime(ctx, key)
+		if atomicStore != nil {
+			allowance := p.delayVariationTolerance + maxDelay
+			if allowance < 0 {
+				// maxDelay is effectively unbounded and overflowed
+				allowance = time.Duration(math.MaxInt64)
+			}
+			tatVal, now, updated, err = atomicStore.AdvanceWithTime(ctx, key, increment, allowance)
+		} else {
+			tatVal, now, err = g.store.GetWithTime(ctx, key)
+		}
 		if err != nil {
-			return false, rlc, err
+			return false, rlc, 0, err
 		}
 
 		if tatVal == -1 {
@@ -205,34 +443,63 @@ func (g *GCRARateLimiterCtx) RateLimitCtx(ctx context.Context, key string, quant
 			tat = time.Unix(0, tatVal)
 		}
 
-		increment := time.Duration(quantity) * g.emissionInterval
+		// A key further ahead of its schedule than the tolerance permits
+		// was written under a previous quota
+		clamped := false
+		if maxTat := now.Add(p.delayVariationTolerance); tat.After(maxTat) && p.inTransition(now) {
+			tat = maxTat
+			clamped = true
+		}
+
 		if now.After(tat) {
 			newTat = now.Add(increment)
 		} else {
 			newTat = tat.Add(increment)
 		}
 
-		// Block the request if the next permitted time is in the future
-		allowAt := newTat.Add(-(g.delayVariationTolerance))
-		if diff := now.Sub(allowAt); diff < 0 {
-			if increment <= g.delayVariationTolerance {
+		// Block the request if the next permitted time is further in the
+		// future than the caller is willing to wait. An atomic store has
+		// already made that decision.
+		allowAt := newTat.Add(-(p.delayVariationTolerance))
+		diff := now.Sub(allowAt)
+		blocked := diff < -maxDelay
+		if atomicStore != nil {
+			blocked = !updated
+		}
+		limited = blocked
+		rlc.RetryAfter = -1
+		if blocked {
+			if increment <= p.delayVariationTolerance {
 				rlc.RetryAfter = -diff
 				ttl = tat.Sub(now)
 			}
-			limited = true
-			break
-		}
+			if !clamped {
+				break
+			}
+			// Store the clamped state so that the key recovers from it
+			// instead of being limited until the transition ends.
+			newTat = tat
+		} else {
+			delay = 0
+			if diff < 0 {
+				delay = -diff
+			}
 
-		ttl = newTat.Sub(now)
+			ttl = newTat.Sub(now)
+
+			if atomicStore != nil {
+				break
+			}
+		}
 
 		if tatVal == -1 {
-			updated, err = g.store.SetIfNotExistsWithTTL(ctx, key, newTat.UnixNano(), ttl)
+			updated, err = g.store.SetIfNotExistsWithTTL(ctx, key, newTat.UnixNano(), newTat.Sub(now))
 		} else {
-			updated, err = g.store.CompareAndSwapWithTTL(ctx, key, tatVal, newTat.UnixNano(), ttl)
+			updated, err = g.store.CompareAndSwapWithTTL(ctx, key, tatVal, newTat.UnixNano(), newTat.Sub(now))
 		}
 
 		if err != nil {
-			return false, rlc, err
+			return false, rlc, 0, err
 		}
 		if updated {
 			break
@@ -240,18 +507,18 @@ func (g *GCRARateLimiterCtx) RateLimitCtx(ctx context.Context, key string, quant
 
 		i++
 		if i >= g.maxCASAttemptsLimit {
-			return false, rlc, fmt.Errorf(
+			return false, rlc, 0, fmt.Errorf(
 				"Failed to store updated rate limit data for key %s after %d attempts",
 				key, i,
 			)
 		}
 	}
 
-	next := g.delayVariationTolerance - ttl
-	if next > -g.emissionInterval {
-		rlc.Remaining = int(next / g.emissionInterval)
+	next := p.delayVariationTolerance - ttl
+	if next > -p.emissionInterval {
+		rlc.Remaining = int(next / p.emissionInterval)
 	}
 	rlc.ResetAfter = ttl
 
-	return limited, rlc, nil
+	return limited, rlc, delay, nil
 }
@@ -2,6 +2,7 @@ package throttled_test
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 
@@ -38,7 +39,49 @@ func (ts *testStore) CompareAndSwapWithTTL(ctx context.Context, key string, old,
 	return ts.store.CompareAndSwapWithTTL(ctx, key, old, new, ttl)
 }
 
+// atomicTestStore is a testStore that also evaluates updates atomically.
+type atomicTestStore struct {
+	*testStore
+
+	mu sync.Mutex
+}
+
+func (ts *atomicTestStore) AdvanceWithTime(ctx context.Context, key string, increment, allowance time.Duration) (int64, time.Time, bool, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	v, now, err := ts.GetWithTime(ctx, key)
+	if err != nil {
+		return 0, now, false, err
+	}
+
+	tat := now
+	if v != -1 && time.Unix(0, v).After(now) {
+		tat = time.Unix(0, v)
+	}
+	newTat := tat.Add(increment)
+	if newTat.After(now.Add(allowance)) {
+		return v, now, false, nil
+	}
+
+	var updated bool
+	if v == -1 {
+		updated, err = ts.SetIfNotExistsWithTTL(ctx, key, newTat.UnixNano(), newTat.Sub(now))
+	} else {
+		updated, err = ts.CompareAndSwapWithTTL(ctx, key, v, newTat.UnixNano(), newTat.Sub(now))
+	}
+	return v, now, updated, err
+}
+
 func TestRateLimit(t *testing.T) {
+	testRateLimit(t, false)
+}
+
+func TestRateLimitAtomic(t *testing.T) {
+	testRateLimit(t, true)
+}
+
+func testRateLimit(t *testing.T, atomic bool) {
 	limit := 5
 	rq := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: limit - 1}
 	start := time.Unix(0, 0)
@@ -78,7 +121,12 @@ func TestRateLimit(t *testing.T) {
 	}
 	st := testStore{store: mst}
 
-	rl, err := throttled.NewGCRARateLimiterCtx(&st, rq)
+	var rst throttled.GCRAStoreCtx = &st
+	if atomic {
+		rst = &atomicTestStore{testStore: &st}
+	}
+
+	rl, err := throttled.NewGCRARateLimiterCtx(rst, rq)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -144,6 +192,37 @@ func TestRateLimitCustomPeriod(t *testing.T) {
 	}
 }
 
+func TestRateLimitExceedingBurst(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 2}
+	for _, atomic := range []bool{false, true} {
+		mst, err := memstore.NewCtx(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var st throttled.GCRAStoreCtx = &testStore{store: mst, clock: time.Unix(0, 0)}
+		if atomic {
+			st = &atomicTestStore{testStore: st.(*testStore)}
+		}
+		rl, err := throttled.NewGCRARateLimiterCtx(st, rq)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		limited, result, err := rl.RateLimitCtx(context.Background(), "foo", 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !limited || result.Remaining != 3 || result.RetryAfter != -1 {
+			t.Errorf("atomic %t: expected the request to be limited with 3 remaining but got %t, %+v", atomic, limited, result)
+		}
+
+		// The request doesn't write to the store
+		if v, _, err := mst.GetWithTime(context.Background(), "foo"); err != nil || v != -1 {
+			t.Errorf("atomic %t: expected the key not to be stored but got %d, %v", atomic, v, err)
+		}
+	}
+}
+
 func TestRateLimitUpdateFailures(t *testing.T) {
 	rq := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 1}
 	mst, err := memstore.NewCtx(0)
@@ -182,6 +261,96 @@ func TestRateLimitUpdateFailuresWithRetryLimitSetToTwo(t *testing.T) {
 	assert.EqualError(t, err, "Failed to store updated rate limit data for key foo after 2 attempts")
 }
 
+func TestUpdateQuota(t *testing.T) {
+	testUpdateQuota(t, false)
+}
+
+func TestUpdateQuotaAtomic(t *testing.T) {
+	testUpdateQuota(t, true)
+}
+
+func testUpdateQuota(t *testing.T, atomic bool) {
+	large := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 9}
+	small := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 1}
+	medium := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 4}
+	start := time.Unix(0, 0)
+	cases := []struct {
+		quota             *throttled.RateQuota
+		now               time.Time
+		volume, remaining int
+		reset, retry      time.Duration
+		limited           bool
+	}{
+		0: {nil, start, 10, 0, 10 * time.Second, -1, false},
+		// The key is treated as having exhausted the smaller burst
+		// instead of being limited for another ten seconds
+		1: {&small, start, 1, 0, 2 * time.Second, time.Second, true},
+		2: {nil, start.Add(time.Second), 1, 0, 2 * time.Second, -1, false},
+		3: {nil, start.Add(time.Second), 1, 0, 2 * time.Second, time.Second, true},
+		4: {nil, start.Add(3 * time.Second), 1, 1, time.Second, -1, false},
+		// A larger burst is available immediately, with the time owed
+		// under the previous quota carried over
+		5: {&medium, start.Add(3 * time.Second), 1, 3, 2 * time.Second, -1, false},
+	}
+
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := testStore{store: mst}
+
+	var rst throttled.GCRAStoreCtx = &st
+	if atomic {
+		rst = &atomicTestStore{testStore: &st}
+	}
+
+	rl, err := throttled.NewGCRARateLimiterCtx(rst, large)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range cases {
+		st.clock = c.now
+		if c.quota != nil {
+			if err := rl.UpdateQuota(*c.quota); err != nil {
+				t.Fatalf("%d: %#v", i, err)
+			}
+		}
+
+		limited, result, err := rl.RateLimitCtx(context.Background(), "foo", c.volume)
+		if err != nil {
+			t.Fatalf("%d: %#v", i, err)
+		}
+
+		if limited != c.limited {
+			t.Errorf("%d: expected Limited to be %t but got %t", i, c.limited, limited)
+		}
+
+		if have, want := result.Remaining, c.remaining; have != want {
+			t.Errorf("%d: expected Remaining to be %d but got %d", i, want, have)
+		}
+
+		if have, want := result.ResetAfter, c.reset; have != want {
+			t.Errorf("%d: expected ResetAfter to be %s but got %s", i, want, have)
+		}
+
+		if have, want := result.RetryAfter, c.retry; have != want {
+			t.Errorf("%d: expected RetryAfter to be %s but got %s", i, want, have)
+		}
+	}
+
+	if err := rl.UpdateQuota(throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: -1}); err == nil {
+		t.Error("expected updating to an invalid quota to fail")
+	}
+	_, result, err := rl.RateLimitCtx(context.Background(), "foo", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := result.Limit, medium.MaxBurst+1; have != want {
+		t.Errorf("expected a failed update to keep Limit at %d but got %d", want, have)
+	}
+}
+
 func BenchmarkRateLimit(b *testing.B) {
 	limit := 5
 	rq := throttled.RateQuota{MaxRate: throttled.PerSec(1000), MaxBurst: limit - 1}
@@ -0,0 +1,210 @@
+package throttled
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrQuantityExceedsBurst is returned when a quantity could never be
+	// admitted by a rate limiter because it is larger than the maximum
+	// burst permitted by its quota.
+	ErrQuantityExceedsBurst = errors.New("quantity exceeds the maximum burst of the rate limiter")
+
+	// ErrWaitExceedsDeadline is returned by WaitCtx when the request
+	// would not be admitted before the deadline of its context.
+	ErrWaitExceedsDeadline = errors.New("rate limiter wait would exceed the context deadline")
+)
+
+// Reservation describes a quantity that has been booked in advance
+// against the schedule of a GCRARateLimiterCtx for a key. The holder of
+// a reservation is expected to wait for Delay before performing the
+// action it reserved. If the action fails or is abandoned, the booked
+// quantity can be given back with Cancel or Refund so that it does not
+// count against the key's quota.
+type Reservation struct {
+	limiter *GCRARateLimiterCtx
+	key     string
+	delay   time.Duration
+	result  RateLimitResult
+
+	mu       sync.Mutex
+	quantity int // Quantity booked and not yet refunded
+}
+
+// Delay returns how long the holder of the reservation must wait
+// before acting on it. It is 0 if the quantity was admitted
+// immediately.
+func (r *Reservation) Delay() time.Duration { return r.delay }
+
+// Result returns the state of the rate limiter for the reserved key
+// right after the reservation was booked.
+func (r *Reservation) Result() RateLimitResult { return r.result }
+
+// Cancel gives back all of the quantity booked by the reservation that
+// has not already been refunded. It is a no-op for a reservation that
+// was not admitted.
+func (r *Reservation) Cancel(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.refund(ctx, r.quantity)
+}
+
+// Refund gives back up to quantity of the quantity booked by the
+// reservation, for example when only part of the reserved work was
+// performed. The stored theoretical arrival time for the key is moved
+// back by quantity emission intervals, but never before the current
+// time, so a refund cannot grant more than the quota's burst.
+func (r *Reservation) Refund(ctx context.Context, quantity int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if quantity > r.quantity {
+		quantity = r.quantity
+	}
+	return r.refund(ctx, quantity)
+}
+
+func (r *Reservation) refund(ctx context.Context, quantity int) error {
+	if quantity <= 0 {
+		return nil
+	}
+	if err := r.limiter.refund(ctx, r.key, quantity); err != nil {
+		return err
+	}
+	r.quantity -= quantity
+	return nil
+}
+
+// RateLimitReservationCtx is like RateLimitCtx, but returns the outcome
+// as a Reservation which can be cancelled to give the quantity back
+// if the admitted work subsequently fails or is abandoned. The
+// Reservation is returned even if the request was limited, in which
+// case its Result describes why and cancelling it has no effect.
+func (g *GCRARateLimiterCtx) RateLimitReservationCtx(ctx context.Context, key string, quantity int) (bool, *Reservation, error) {
+	limited, rlc, delay, err := g.rateLimit(ctx, key, quantity, 0)
+	if err != nil {
+		return false, nil, err
+	}
+
+	r := &Reservation{limiter: g, key: key, delay: delay, result: rlc}
+	if !limited {
+		r.quantity = quantity
+	}
+	return limited, r, nil
+}
+
+// Reserve books quantity against the schedule for key regardless of
+// how far in the future the next conforming slot is, and returns a
+// Reservation describing how long the caller must wait before acting.
+// Unlike RateLimitCtx, a request that does not conform now is not
+// rejected; the stored state is updated as if it had been admitted at
+// the time given by the delay.
+//
+// Reserve returns ErrQuantityExceedsBurst if quantity is larger than
+// the burst permitted by the quota, as it could never be admitted.
+func (g *GCRARateLimiterCtx) Reserve(ctx context.Context, key string, quantity int) (*Reservation, error) {
+	r, _, err := g.reserve(ctx, key, quantity, time.Duration(math.MaxInt64))
+	return r, err
+}
+
+// WaitCtx blocks until quantity can be admitted for key, booking it
+// against the schedule before returning. It returns
+// ErrWaitExceedsDeadline without waiting or updating the stored state
+// if the request would not be admitted before the deadline of ctx,
+// and the error of ctx if ctx is done while waiting.
+func (g *GCRARateLimiterCtx) WaitCtx(ctx context.Context, key string, quantity int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	maxDelay := time.Duration(math.MaxInt64)
+	if deadline, ok := ctx.Deadline(); ok {
+		maxDelay = time.Until(deadline)
+	}
+
+	r, limited, err := g.reserve(ctx, key, quantity, maxDelay)
+	if err != nil {
+		return err
+	}
+	if limited {
+		return ErrWaitExceedsDeadline
+	}
+	if r.delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(r.delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// The caller gave up before the reserved slot arrived, so release
+		// it for others. ctx is already done and can't be used for that.
+		r.Cancel(context.Background())
+		return ctx.Err()
+	}
+}
+
+func (g *GCRARateLimiterCtx) reserve(ctx context.Context, key string, quantity int, maxDelay time.Duration) (*Reservation, bool, error) {
+	if g.loadParams().exceedsBurst(quantity) {
+		return nil, false, ErrQuantityExceedsBurst
+	}
+
+	limited, rlc, delay, err := g.rateLimit(ctx, key, quantity, maxDelay)
+	if err != nil || limited {
+		return nil, limited, err
+	}
+
+	return &Reservation{
+		limiter:  g,
+		key:      key,
+		delay:    delay,
+		result:   rlc,
+		quantity: quantity,
+	}, false, nil
+}
+
+// refund moves the stored theoretical arrival time for key back by
+// quantity emission intervals using the same compare-and-swap contract
+// as RateLimitCtx.
+func (g *GCRARateLimiterCtx) refund(ctx context.Context, key string, quantity int) error {
+	decrement := time.Duration(quantity) * g.loadParams().emissionInterval
+
+	for i := 0; i < g.maxCASAttemptsLimit; i++ {
+		tatVal, now, err := g.store.GetWithTime(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		// Nothing is owed if the key has expired or already returned to
+		// its initial state
+		tat := time.Unix(0, tatVal)
+		if tatVal == -1 || !tat.After(now) {
+			return nil
+		}
+
+		newTat := tat.Add(-decrement)
+		if newTat.Before(now) {
+			newTat = now
+		}
+
+		updated, err := g.store.CompareAndSwapWithTTL(ctx, key, tatVal, newTat.UnixNano(), newTat.Sub(now))
+		if err != nil {
+			return err
+		}
+		if updated {
+			return nil
+		}
+	}
+
+	return fmt.Errorf(
+		"Failed to store refunded rate limit data for key %s after %d attempts",
+		key, g.maxCASAttemptsLimit,
+	)
+}
@@ -0,0 +1,206 @@
+package throttled_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled/v2"
+	"github.com/throttled/throttled/v2/store/memstore"
+)
+
+func TestReserve(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 1}
+	start := time.Unix(0, 0)
+	cases := []struct {
+		now       time.Time
+		quantity  int
+		delay     time.Duration
+		remaining int
+	}{
+		0: {start, 1, 0, 1},
+		1: {start, 1, 0, 0},
+		2: {start, 1, time.Second, 0},
+		3: {start, 1, 2 * time.Second, 0},
+		4: {start.Add(1500 * time.Millisecond), 2, 2500 * time.Millisecond, 0},
+		5: {start.Add(10 * time.Second), 2, 0, 0},
+	}
+
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := testStore{store: mst}
+
+	rl, err := throttled.NewGCRARateLimiterCtx(&st, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range cases {
+		st.clock = c.now
+
+		r, err := rl.Reserve(context.Background(), "foo", c.quantity)
+		if err != nil {
+			t.Fatalf("%d: %#v", i, err)
+		}
+
+		if have, want := r.Delay(), c.delay; have != want {
+			t.Errorf("%d: expected Delay to be %s but got %s", i, want, have)
+		}
+
+		if have, want := r.Result().Remaining, c.remaining; have != want {
+			t.Errorf("%d: expected Remaining to be %d but got %d", i, want, have)
+		}
+	}
+
+	if _, err := rl.Reserve(context.Background(), "foo", 3); err != throttled.ErrQuantityExceedsBurst {
+		t.Errorf("expected ErrQuantityExceedsBurst but got %v", err)
+	}
+}
+
+func TestWaitCtx(t *testing.T) {
+	period := 50 * time.Millisecond
+	rq := throttled.RateQuota{MaxRate: throttled.PerDuration(1, period), MaxBurst: 0}
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rl, err := throttled.NewGCRARateLimiterCtx(mst, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := rl.WaitCtx(ctx, "foo", 1); err != nil {
+			t.Fatalf("%d: %#v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 2*period {
+		t.Errorf("expected three waits to take at least %s but took %s", 2*period, elapsed)
+	}
+
+	// The next slot is a full period away, which is beyond the deadline
+	shortCtx, cancel := context.WithTimeout(ctx, period/5)
+	defer cancel()
+	if err := rl.WaitCtx(shortCtx, "foo", 1); err != throttled.ErrWaitExceedsDeadline {
+		t.Errorf("expected ErrWaitExceedsDeadline but got %v", err)
+	}
+
+	if err := rl.WaitCtx(ctx, "foo", 2); err != throttled.ErrQuantityExceedsBurst {
+		t.Errorf("expected ErrQuantityExceedsBurst but got %v", err)
+	}
+
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := rl.WaitCtx(cancelledCtx, "foo", 1); err != context.Canceled {
+		t.Errorf("expected context.Canceled but got %v", err)
+	}
+}
+
+func TestReservationCancel(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 4}
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := testStore{store: mst, clock: time.Unix(0, 0)}
+
+	rl, err := throttled.NewGCRARateLimiterCtx(&st, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	remaining := func() int {
+		_, result, err := rl.RateLimitCtx(ctx, "foo", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.Remaining
+	}
+
+	limited, r, err := rl.RateLimitReservationCtx(ctx, "foo", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limited {
+		t.Fatal("expected reservation to be admitted")
+	}
+	if have, want := r.Result().Remaining, 2; have != want {
+		t.Errorf("expected Remaining to be %d but got %d", want, have)
+	}
+
+	if err := r.Refund(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := remaining(), 3; have != want {
+		t.Errorf("expected Remaining to be %d after refund but got %d", want, have)
+	}
+
+	// Cancelling gives back what is left and only that
+	if err := r.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := remaining(), 5; have != want {
+		t.Errorf("expected Remaining to be %d after cancel but got %d", want, have)
+	}
+
+	// A limited reservation has nothing to give back
+	if _, _, err := rl.RateLimitCtx(ctx, "foo", 5); err != nil {
+		t.Fatal(err)
+	}
+	limited, r, err = rl.RateLimitReservationCtx(ctx, "foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !limited {
+		t.Fatal("expected reservation to be limited")
+	}
+	if err := r.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := remaining(), 0; have != want {
+		t.Errorf("expected Remaining to be %d but got %d", want, have)
+	}
+}
+
+func TestWaitCtxCancelRefunds(t *testing.T) {
+	period := time.Second
+	rq := throttled.RateQuota{MaxRate: throttled.PerDuration(1, period), MaxBurst: 0}
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rl, err := throttled.NewGCRARateLimiterCtx(mst, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := rl.WaitCtx(ctx, "foo", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// This wait books the next slot and gives it back when cancelled
+	cancelCtx, cancel := context.WithCancel(ctx)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := rl.WaitCtx(cancelCtx, "foo", 1); err != context.Canceled {
+		t.Fatalf("expected context.Canceled but got %v", err)
+	}
+
+	_, result, err := rl.RateLimitCtx(ctx, "foo", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ResetAfter > period {
+		t.Errorf("expected cancelled wait to be refunded but ResetAfter is %s", result.ResetAfter)
+	}
+}
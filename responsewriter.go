@@ -0,0 +1,105 @@
+package throttled
+
+import "net/http"
+
+// responseRecorder is an http.ResponseWriter that records the status
+// code and the number of body bytes written to the ResponseWriter it
+// wraps.
+type responseRecorder struct {
+	http.ResponseWriter
+
+	status int
+	bytes  int64
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	// Informational responses may precede the final status
+	if rec.status == 0 && code >= 200 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// statusCode returns the status code of the response, which is 200 if
+// the handler didn't write anything.
+func (rec *responseRecorder) statusCode() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+type recordingFlusher struct {
+	rec     *responseRecorder
+	flusher http.Flusher
+}
+
+func (f recordingFlusher) Flush() {
+	if f.rec.status == 0 {
+		f.rec.status = http.StatusOK
+	}
+	f.flusher.Flush()
+}
+
+// wrap returns a ResponseWriter writing to rec that implements the same
+// combination of http.Flusher, http.Hijacker and http.Pusher as w, so
+// that handlers detecting them keep working.
+func (rec *responseRecorder) wrap(w http.ResponseWriter) http.ResponseWriter {
+	flusher, isFlusher := w.(http.Flusher)
+	hijacker, isHijacker := w.(http.Hijacker)
+	pusher, isPusher := w.(http.Pusher)
+	f := recordingFlusher{rec, flusher}
+
+	switch {
+	case isFlusher && isHijacker && isPusher:
+		return struct {
+			*responseRecorder
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{rec, f, hijacker, pusher}
+	case isFlusher && isHijacker:
+		return struct {
+			*responseRecorder
+			http.Flusher
+			http.Hijacker
+		}{rec, f, hijacker}
+	case isFlusher && isPusher:
+		return struct {
+			*responseRecorder
+			http.Flusher
+			http.Pusher
+		}{rec, f, pusher}
+	case isHijacker && isPusher:
+		return struct {
+			*responseRecorder
+			http.Hijacker
+			http.Pusher
+		}{rec, hijacker, pusher}
+	case isFlusher:
+		return struct {
+			*responseRecorder
+			http.Flusher
+		}{rec, f}
+	case isHijacker:
+		return struct {
+			*responseRecorder
+			http.Hijacker
+		}{rec, hijacker}
+	case isPusher:
+		return struct {
+			*responseRecorder
+			http.Pusher
+		}{rec, pusher}
+	}
+	return rec
+}
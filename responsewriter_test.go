@@ -0,0 +1,195 @@
+package throttled_test
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled/v2"
+	"github.com/throttled/throttled/v2/store/memstore"
+)
+
+func TestHTTPRateLimiterChargeAfter(t *testing.T) {
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 2}
+	rl, err := throttled.NewGCRARateLimiterCtx(&testStore{store: mst, clock: time.Unix(0, 0)}, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only failed logins count against the limit
+	limiter := throttled.HTTPRateLimiterCtx{
+		RateLimiter: rl,
+		ChargeAfter: func(status int, bytesWritten int64, r *http.Request) int {
+			if status == http.StatusUnauthorized {
+				return 1
+			}
+			return 0
+		},
+	}
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "fail" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"ok", 200, map[string]string{"X-Ratelimit-Remaining": "3"}},
+		{"fail", 401, map[string]string{"X-Ratelimit-Remaining": "3"}},
+		{"ok", 200, map[string]string{"X-Ratelimit-Remaining": "2"}},
+		{"fail", 401, map[string]string{"X-Ratelimit-Remaining": "2"}},
+		{"fail", 401, map[string]string{"X-Ratelimit-Remaining": "1"}},
+		{"ok", 429, map[string]string{"X-Ratelimit-Remaining": "0", "Retry-After": "60"}},
+	})
+}
+
+func TestHTTPRateLimiterChargeAfterWrapped(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 2}
+	newStore := func() *testStore {
+		mst, err := memstore.NewCtx(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &testStore{store: mst, clock: time.Unix(0, 0)}
+	}
+
+	gcra, err := throttled.NewGCRARateLimiterCtx(newStore(), rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failSafe, err := throttled.NewFailSafeRateLimiterCtx(gcra, throttled.FailOpen, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	multi, err := throttled.NewMultiRateLimiterCtx(newStore(), rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wrapping limiters tell when the next request is permitted
+	for name, rl := range map[string]throttled.RateLimiterCtx{"FailSafe": failSafe, "Multi": multi} {
+		limiter := throttled.HTTPRateLimiterCtx{
+			RateLimiter: rl,
+			ChargeAfter: func(status int, bytesWritten int64, r *http.Request) int {
+				return 1
+			},
+		}
+		handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		t.Run(name, func(t *testing.T) {
+			runHTTPTestCases(t, handler, []httpTestCase{
+				{"/", 200, map[string]string{"X-Ratelimit-Remaining": "3"}},
+				{"/", 200, map[string]string{"X-Ratelimit-Remaining": "2"}},
+				{"/", 200, map[string]string{"X-Ratelimit-Remaining": "1"}},
+				{"/", 429, map[string]string{"X-Ratelimit-Remaining": "0", "Retry-After": "60"}},
+			})
+		})
+	}
+}
+
+func TestHTTPRateLimiterChargeAfterBytes(t *testing.T) {
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 9}
+	rl, err := throttled.NewGCRARateLimiterCtx(&testStore{store: mst, clock: time.Unix(0, 0)}, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := throttled.HTTPRateLimiterCtx{
+		RateLimiter: rl,
+		ChargeAfter: func(status int, bytesWritten int64, r *http.Request) int {
+			return int((bytesWritten + 9) / 10)
+		},
+	}
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 15))
+		w.Write(make([]byte, 10))
+	}))
+
+	// The last response costs more than remains, using up the rest
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"/", 200, map[string]string{"X-Ratelimit-Remaining": "10"}},
+		{"/", 200, map[string]string{"X-Ratelimit-Remaining": "7"}},
+		{"/", 200, map[string]string{"X-Ratelimit-Remaining": "4"}},
+		{"/", 200, map[string]string{"X-Ratelimit-Remaining": "1"}},
+		{"/", 429, map[string]string{"X-Ratelimit-Remaining": "0"}},
+	})
+}
+
+type fullResponseWriter struct {
+	*httptest.ResponseRecorder
+	pushed string
+}
+
+func (w *fullResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, http.ErrHijacked
+}
+
+func (w *fullResponseWriter) Push(target string, opts *http.PushOptions) error {
+	w.pushed = target
+	return nil
+}
+
+type plainResponseWriter struct {
+	http.ResponseWriter
+}
+
+func TestHTTPRateLimiterChargeAfterResponseWriter(t *testing.T) {
+	var status int
+	var bytes int64
+	limiter := throttled.HTTPRateLimiterCtx{
+		RateLimiter: &stubLimiter{},
+		ChargeAfter: func(s int, b int64, r *http.Request) int {
+			status, bytes = s, b
+			return 0
+		},
+	}
+
+	var flusher, hijacker, pusher bool
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var f http.Flusher
+		f, flusher = w.(http.Flusher)
+		_, hijacker = w.(http.Hijacker)
+		var p http.Pusher
+		p, pusher = w.(http.Pusher)
+
+		if pusher {
+			p.Push("/style.css", nil)
+		}
+		if flusher {
+			f.Flush()
+		}
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("hello"))
+	}))
+
+	full := &fullResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(full, httptest.NewRequest("GET", "/", nil))
+	if !flusher || !hijacker || !pusher {
+		t.Errorf("expected Flusher, Hijacker and Pusher to be preserved but got %t, %t, %t", flusher, hijacker, pusher)
+	}
+	if !full.Flushed || full.pushed != "/style.css" {
+		t.Error("expected Flush and Push to reach the ResponseWriter")
+	}
+	if status != http.StatusOK || bytes != 5 {
+		t.Errorf("expected the flushed response to be charged with 200 and 5 bytes but got %d and %d", status, bytes)
+	}
+
+	plain := &plainResponseWriter{httptest.NewRecorder()}
+	handler.ServeHTTP(plain, httptest.NewRequest("GET", "/", nil))
+	if flusher || hijacker || pusher {
+		t.Errorf("expected no optional interfaces but got %t, %t, %t", flusher, hijacker, pusher)
+	}
+	if status != http.StatusTeapot || bytes != 5 {
+		t.Errorf("expected the response to be charged with 418 and 5 bytes but got %d and %d", status, bytes)
+	}
+}
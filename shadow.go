@@ -0,0 +1,133 @@
+package throttled
+
+import (
+	"context"
+	"errors"
+)
+
+// ShadowReport describes the decision a candidate limiter of a
+// ShadowRateLimiterCtx made for a request.
+type ShadowReport struct {
+	// Key and Quantity are the arguments the request was rate limited
+	// with. Key doesn't include the prefix the candidate limiter was
+	// passed the key with.
+	Key      string
+	Quantity int
+
+	// Limited and Result are the decision of the candidate limiter.
+	Limited bool
+	Result  RateLimitResult
+
+	// Err is the error returned by the candidate limiter, if any, in
+	// which case Limited and Result are meaningless.
+	Err error
+
+	// EnforcedLimited is whether the enforced limiter limited the
+	// request, which is always false in a dry run without one.
+	EnforcedLimited bool
+}
+
+// ShadowRateLimiterCtx is a RateLimiterCtx that evaluates a candidate
+// limiter against all requests without enforcing its decisions, so that
+// a new quota can be tried out on real traffic before it is rolled out.
+// Each decision of the candidate is passed to a report function, for
+// example to record metrics of the requests it would have limited.
+//
+// Requests are rate limited by an enforced limiter as usual. Without
+// one, every request is permitted.
+//
+// The candidate limiter is passed each key with a prefix, "shadow:" by
+// default, so that it doesn't count requests under the same keys as the
+// enforced limiter if both use the same store.
+type ShadowRateLimiterCtx struct {
+	enforced  RateLimiterCtx
+	candidate RateLimiterCtx
+	report    func(ctx context.Context, r ShadowReport)
+	keyPrefix string
+}
+
+// NewShadowRateLimiterCtx creates a ShadowRateLimiterCtx that limits
+// requests with enforced, which may be nil for a dry run, and reports
+// the decisions of candidate to report. The candidate is evaluated
+// after the enforced limiter and counts each request even if the
+// enforced limiter limited it.
+func NewShadowRateLimiterCtx(enforced, candidate RateLimiterCtx, report func(ctx context.Context, r ShadowReport)) (*ShadowRateLimiterCtx, error) {
+	if candidate == nil {
+		return nil, errors.New("a candidate RateLimiterCtx is required")
+	}
+	if report == nil {
+		return nil, errors.New("a report function is required")
+	}
+	return &ShadowRateLimiterCtx{
+		enforced:  enforced,
+		candidate: candidate,
+		report:    report,
+		keyPrefix: "shadow:",
+	}, nil
+}
+
+// SetKeyPrefix sets the prefix of the keys passed to the candidate
+// limiter, which is "shadow:" by default. An empty prefix passes the
+// keys unchanged, for example if the limiters use separate stores. It
+// must be called before the limiter is used.
+func (s *ShadowRateLimiterCtx) SetKeyPrefix(prefix string) {
+	s.keyPrefix = prefix
+}
+
+// RateLimitCtx returns the decision of the enforced limiter after
+// reporting the decision of the candidate limiter. Errors of the
+// candidate limiter are only reported.
+//
+// Without an enforced limiter, the request is never limited and the
+// RateLimitResult is that of the candidate limiter, except for
+// RetryAfter, which is always -1.
+func (s *ShadowRateLimiterCtx) RateLimitCtx(ctx context.Context, key string, quantity int) (bool, RateLimitResult, error) {
+	var limited bool
+	var result RateLimitResult
+	if s.enforced != nil {
+		var err error
+		limited, result, err = s.enforced.RateLimitCtx(ctx, key, quantity)
+		if err != nil {
+			return false, RateLimitResult{}, err
+		}
+	}
+
+	report := ShadowReport{Key: key, Quantity: quantity, EnforcedLimited: limited}
+	report.Limited, report.Result, report.Err = s.candidate.RateLimitCtx(ctx, s.keyPrefix+key, quantity)
+	s.report(ctx, report)
+
+	if s.enforced == nil {
+		result = report.Result
+		result.RetryAfter = -1
+		if report.Err != nil {
+			result = RateLimitResult{Limit: -1, Remaining: -1, ResetAfter: -1, RetryAfter: -1}
+		}
+	}
+	return limited, result, nil
+}
+
+// PeekCtx returns the state of key in the enforced limiter without
+// updating it, with RetryAfter set to the time until quantity would be
+// permitted, or -1 if it would be permitted now or never. It returns
+// ErrPeekNotSupported if the enforced limiter doesn't implement Peeker.
+//
+// Without an enforced limiter, quantity is always permitted and the
+// state is that of the candidate limiter, like for RateLimitCtx.
+func (s *ShadowRateLimiterCtx) PeekCtx(ctx context.Context, key string, quantity int) (RateLimitResult, error) {
+	if s.enforced == nil {
+		result := RateLimitResult{Limit: -1, Remaining: -1, ResetAfter: -1}
+		if p, ok := s.candidate.(Peeker); ok {
+			if r, err := p.PeekCtx(ctx, s.keyPrefix+key, quantity); err == nil {
+				result = r
+			}
+		}
+		result.RetryAfter = -1
+		return result, nil
+	}
+
+	p, ok := s.enforced.(Peeker)
+	if !ok {
+		return RateLimitResult{}, ErrPeekNotSupported
+	}
+	return p.PeekCtx(ctx, key, quantity)
+}
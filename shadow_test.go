@@ -0,0 +1,160 @@
+package throttled_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled/v2"
+	"github.com/throttled/throttled/v2/store/memstore"
+)
+
+func newTestGCRA(t *testing.T, burst int) *throttled.GCRARateLimiterCtx {
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: burst}
+	rl, err := throttled.NewGCRARateLimiterCtx(&testStore{store: mst, clock: time.Unix(0, 0)}, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rl
+}
+
+func TestShadowRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	var reports []throttled.ShadowReport
+	report := func(_ context.Context, r throttled.ShadowReport) {
+		reports = append(reports, r)
+	}
+
+	rl, err := throttled.NewShadowRateLimiterCtx(newTestGCRA(t, 2), newTestGCRA(t, 0), report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range []struct {
+		limited, candidateLimited bool
+		remaining                 int
+	}{
+		0: {false, false, 2},
+		1: {false, true, 1},
+		2: {false, true, 0},
+		3: {true, true, 0},
+	} {
+		limited, result, err := rl.RateLimitCtx(ctx, "foo", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limited != c.limited || result.Remaining != c.remaining {
+			t.Errorf("%d: expected limited %t with %d remaining but got %t with %d",
+				i, c.limited, c.remaining, limited, result.Remaining)
+		}
+
+		r := reports[len(reports)-1]
+		if r.Key != "foo" || r.Quantity != 1 || r.Err != nil {
+			t.Errorf("%d: unexpected report %+v", i, r)
+		}
+		if r.Limited != c.candidateLimited || r.EnforcedLimited != c.limited {
+			t.Errorf("%d: expected the candidate to limit %t and the enforced limiter %t but got %t and %t",
+				i, c.candidateLimited, c.limited, r.Limited, r.EnforcedLimited)
+		}
+	}
+	if len(reports) != 4 {
+		t.Errorf("expected 4 reports but got %d", len(reports))
+	}
+}
+
+func TestShadowRateLimiterSharedStore(t *testing.T) {
+	ctx := context.Background()
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &testStore{store: mst, clock: time.Unix(0, 0)}
+	newGCRA := func(burst int) *throttled.GCRARateLimiterCtx {
+		rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: burst}
+		rl, err := throttled.NewGCRARateLimiterCtx(st, rq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rl
+	}
+
+	var reports []throttled.ShadowReport
+	rl, err := throttled.NewShadowRateLimiterCtx(newGCRA(2), newGCRA(2), func(_ context.Context, r throttled.ShadowReport) {
+		reports = append(reports, r)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each request is counted once by each limiter
+	for i := 0; i < 3; i++ {
+		limited, result, err := rl.RateLimitCtx(ctx, "foo", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := reports[len(reports)-1]
+		if limited || r.Limited || result.Remaining != 2-i || r.Result.Remaining != 2-i {
+			t.Errorf("%d: expected both limiters to permit the request with %d remaining but got %t with %d and %t with %d",
+				i, 2-i, limited, result.Remaining, r.Limited, r.Result.Remaining)
+		}
+		if r.Key != "foo" {
+			t.Errorf("%d: expected the report to be for key foo but got %q", i, r.Key)
+		}
+	}
+
+	for _, key := range []string{"foo", "shadow:foo"} {
+		if value, _, err := mst.GetWithTime(ctx, key); err != nil || value == -1 {
+			t.Errorf("expected key %q to be stored but got %d, %v", key, value, err)
+		}
+	}
+}
+
+func TestShadowRateLimiterDryRun(t *testing.T) {
+	ctx := context.Background()
+	var last throttled.ShadowReport
+	rl, err := throttled.NewShadowRateLimiterCtx(nil, newTestGCRA(t, 0), func(_ context.Context, r throttled.ShadowReport) {
+		last = r
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		limited, result, err := rl.RateLimitCtx(ctx, "foo", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limited || result.RetryAfter != -1 {
+			t.Errorf("%d: expected the request to be permitted but got %t, %+v", i, limited, result)
+		}
+		if have, want := last.Limited, i > 0; have != want {
+			t.Errorf("%d: expected the candidate to limit %t but got %t", i, want, have)
+		}
+	}
+
+	rl, err = throttled.NewShadowRateLimiterCtx(nil, &stubLimiter{}, func(_ context.Context, r throttled.ShadowReport) {
+		last = r
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.SetKeyPrefix("")
+	limited, _, err := rl.RateLimitCtx(ctx, "error", 1)
+	if limited || err != nil {
+		t.Errorf("expected candidate errors to be ignored but got %t, %v", limited, err)
+	}
+	if last.Err == nil {
+		t.Error("expected the candidate error to be reported")
+	}
+
+	if _, err := throttled.NewShadowRateLimiterCtx(nil, nil, func(context.Context, throttled.ShadowReport) {}); err == nil {
+		t.Error("expected an error without a candidate")
+	}
+	if _, err := throttled.NewShadowRateLimiterCtx(nil, &stubLimiter{}, nil); err == nil {
+		t.Error("expected an error without a report function")
+	}
+}
@@ -33,3 +33,94 @@ type GCRAStoreCtx interface {
 	// will expire after the provided ttl.
 	CompareAndSwapWithTTL(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error)
 }
+
+// GCRAStoreAtomicCtx is an optional interface that a GCRAStoreCtx can
+// implement to evaluate a GCRA update in a single atomic operation
+// instead of a GetWithTime followed by SetIfNotExistsWithTTL or
+// CompareAndSwapWithTTL. GCRARateLimiterCtx uses it whenever its store
+// implements it, which avoids retrying under contention and saves a
+// round trip for stores that live on another machine.
+type GCRAStoreAtomicCtx interface {
+	GCRAStoreCtx
+
+	// AdvanceWithTime atomically reads the value of key, treating a
+	// missing key or a value before the current time as the current
+	// time, and adds increment to it. The new value is only stored if
+	// it is no later than the current time plus allowance. It returns
+	// the previous value of the key or -1 if it did not exist, the
+	// current time at the Store and whether the new value was stored.
+	// If the store supports expiring keys and a new value was stored,
+	// the key will expire once the current time reaches the new value.
+	AdvanceWithTime(ctx context.Context, key string, increment, allowance time.Duration) (int64, time.Time, bool, error)
+}
+
+// gcraStoreAtomic is the version of GCRAStoreAtomicCtx that is not aware
+// of context. A GCRAStore implementing it is wrapped as a
+// GCRAStoreAtomicCtx by WrapStoreWithContext.
+type gcraStoreAtomic interface {
+	AdvanceWithTime(key string, increment, allowance time.Duration) (int64, time.Time, bool, error)
+}
+
+// StoreAdminCtx is an optional interface that a store can implement to
+// support administrative operations on the state it holds, such as
+// clearing the state of a key after it has been unblocked manually.
+type StoreAdminCtx interface {
+	// Delete removes all state stored for key. Deleting a key that
+	// doesn't exist is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// Keys returns the keys starting with prefix for which state is
+	// stored, in no particular order. Keys that expire while they are
+	// being listed may or may not be returned.
+	Keys(ctx context.Context, prefix string) ([]string, error)
+}
+
+// storeAdmin is the version of StoreAdminCtx that is not aware of
+// context. A GCRAStore implementing it is wrapped as a StoreAdminCtx by
+// WrapStoreWithContext.
+type storeAdmin interface {
+	Delete(key string) error
+	Keys(prefix string) ([]string, error)
+}
+
+// WindowStoreCtx is the interface to implement to store state for the
+// window based rate limiters SlidingWindowRateLimiterCtx and
+// FixedWindowRateLimiterCtx. Windows are aligned to multiples of their
+// size since the epoch.
+type WindowStoreCtx interface {
+	// IncrementWithTime atomically adds delta to the counter for key in
+	// the window of the given size containing the current time at the
+	// Store, creating the counter if it doesn't exist. It returns the
+	// new value of that counter, the value of the counter for the
+	// window immediately before it and the current time at the Store.
+	// Missing counters count as 0, and a delta of 0 only reads the
+	// counters. If the store supports expiring keys, a counter will
+	// expire once it is no longer for the current or previous window.
+	IncrementWithTime(ctx context.Context, key string, window time.Duration, delta int64) (int64, int64, time.Time, error)
+
+	// IncrementAt atomically adds delta to the counter for key in the
+	// window of the given size containing at, but only if the counter
+	// still exists. It is used to roll back increments that exceeded a
+	// limit.
+	IncrementAt(ctx context.Context, key string, window time.Duration, at time.Time, delta int64) error
+}
+
+// ConcurrencyStoreCtx is the interface to implement to store the leases
+// held on the slots of a ConcurrencyLimiterCtx.
+type ConcurrencyStoreCtx interface {
+	// AcquireLease atomically removes the expired leases for key and,
+	// if fewer than limit leases remain, adds a lease identified by id
+	// that expires after ttl. It returns whether the lease was added
+	// and the number of unexpired leases held for key afterwards.
+	AcquireLease(ctx context.Context, key, id string, limit int, ttl time.Duration) (bool, int, error)
+
+	// ReleaseLease removes the lease identified by id for key.
+	// Releasing a lease that doesn't exist or has expired is not an
+	// error.
+	ReleaseLease(ctx context.Context, key, id string) error
+
+	// ExtendLease sets the lease identified by id for key to expire
+	// after ttl if it is still held. It returns false if the lease
+	// doesn't exist or has expired, as its slot may have been taken.
+	ExtendLease(ctx context.Context, key, id string, ttl time.Duration) (bool, error)
+}
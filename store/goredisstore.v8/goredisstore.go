@@ -3,7 +3,10 @@ package goredisstore // import "github.com/throttled/throttled/v2/store/gorediss
 
 import (
 	"context"
+	"fmt"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -21,6 +24,50 @@ if v ~= ARGV[1] then
 end
 redis.call('setex', KEYS[1], ARGV[3], ARGV[2])
 return 1
+`
+
+	// redisGCRAScript evaluates a GCRA update server-side. Lua numbers
+	// are doubles, which can't hold nanoseconds since the epoch exactly,
+	// so times are split into microseconds and a nanosecond remainder.
+	redisGCRAScript = `
+redis.replicate_commands()
+local function split(s)
+  local n = string.len(s)
+  if n <= 3 then
+    return 0, tonumber(s)
+  end
+  return tonumber(string.sub(s, 1, n - 3)), tonumber(string.sub(s, n - 2))
+end
+local function add(aus, ans, bus, bns)
+  local us, ns = aus + bus, ans + bns
+  if ns >= 1000 then
+    return us + 1, ns - 1000
+  end
+  return us, ns
+end
+local t = redis.call('time')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local v = redis.call('get', KEYS[1])
+local tatus, tatns = now, 0
+if v then
+  tatus, tatns = split(v)
+end
+if tatus < now then
+  tatus, tatns = now, 0
+end
+local incus, incns = split(ARGV[1])
+local newus, newns = add(tatus, tatns, incus, incns)
+local allus, allns = split(ARGV[2])
+local maxus, maxns = add(now, 0, allus, allns)
+if newus > maxus or (newus == maxus and newns > maxns) then
+  return {v or '-1', t[1], t[2], 0}
+end
+local ttl = math.floor((newus - now) / 1000000)
+if ttl < 1 then
+  ttl = 1
+end
+redis.call('set', KEYS[1], string.format('%d%03d', newus, newns), 'EX', ttl)
+return {v or '-1', t[1], t[2], 1}
 `
 )
 
@@ -126,3 +173,114 @@ func (r *GoRedisStore) CompareAndSwapWithTTL(ctx context.Context, key string, ol
 
 	return swapped, nil
 }
+
+// AdvanceWithTime atomically evaluates a GCRA update for key in a
+// single round trip using a Lua script, which makes the store usable
+// as a throttled.GCRAStoreAtomicCtx. It returns the previous value of
+// the key or -1 if it did not exist, the current time at the redis
+// server to microsecond precision and whether the new value was
+// stored. Depends on Redis 3.2+ for script effects replication.
+func (r *GoRedisStore) AdvanceWithTime(ctx context.Context, key string, increment, allowance time.Duration) (int64, time.Time, bool, error) {
+	key = r.prefix + key
+
+	result, err := r.client.Eval(ctx, redisGCRAScript, []string{key}, int64(increment), int64(allowance)).Result()
+	if err != nil {
+		return 0, time.Time{}, false, err
+	}
+
+	return parseGCRAReply(result)
+}
+
+// Delete removes all state stored for key, which makes GoRedisStore
+// usable as a throttled.StoreAdminCtx.
+func (r *GoRedisStore) Delete(ctx context.Context, key string) error {
+	return r.client.Del(ctx, r.prefix+key).Err()
+}
+
+// Keys returns the keys in the store starting with prefix, in no
+// particular order, without the key prefix of the store. It uses SCAN
+// on every master node when the client is a Redis Cluster client.
+func (r *GoRedisStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	pattern := escapeGlob(r.prefix+prefix) + "*"
+
+	var mu sync.Mutex
+	seen := make(map[string]struct{})
+	keys := []string{}
+
+	scan := func(ctx context.Context, client redis.Cmdable) error {
+		iter := client.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			// SCAN may return a key more than once
+			mu.Lock()
+			if k := iter.Val(); !contains(seen, k) {
+				seen[k] = struct{}{}
+				keys = append(keys, strings.TrimPrefix(k, r.prefix))
+			}
+			mu.Unlock()
+		}
+		return iter.Err()
+	}
+
+	var err error
+	if cluster, ok := r.client.(*redis.ClusterClient); ok {
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return scan(ctx, client)
+		})
+	} else {
+		err = scan(ctx, r.client)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// parseGCRAReply converts the reply of redisGCRAScript into the return
+// values of AdvanceWithTime.
+func parseGCRAReply(reply interface{}) (int64, time.Time, bool, error) {
+	var now time.Time
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 4 {
+		return 0, now, false, fmt.Errorf("unexpected reply from GCRA script: %v", reply)
+	}
+
+	var ints [3]int64
+	for i := range ints {
+		s, ok := values[i].(string)
+		if !ok {
+			return 0, now, false, fmt.Errorf("unexpected reply from GCRA script: %v", reply)
+		}
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, now, false, err
+		}
+		ints[i] = v
+	}
+	advanced, ok := values[3].(int64)
+	if !ok {
+		return 0, now, false, fmt.Errorf("unexpected reply from GCRA script: %v", reply)
+	}
+
+	now = time.Unix(ints[1], ints[2]*int64(time.Microsecond))
+	return ints[0], now, advanced == 1, nil
+}
+
+func contains(set map[string]struct{}, k string) bool {
+	_, ok := set[k]
+	return ok
+}
+
+// escapeGlob escapes the characters of s that have a special meaning
+// in the glob-style patterns of Redis.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -52,6 +52,8 @@ func TestRedisStore(t *testing.T) {
 	clearRedis(c)
 	storetest.TestGCRAStoreCtx(t, st)
 	storetest.TestGCRAStoreTTLCtx(t, st)
+	storetest.TestGCRAStoreAtomicCtx(t, st)
+	storetest.TestStoreAdminCtx(t, st)
 }
 
 func BenchmarkRedisStore(b *testing.B) {
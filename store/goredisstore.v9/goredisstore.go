@@ -3,13 +3,23 @@ package goredisstore // import "github.com/throttled/throttled/v2/store/gorediss
 
 import (
 	"context"
+	"fmt"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
 const (
+	// Window counters and leases are stored under the key followed by
+	// these suffixes, so that limiters of different kinds can share a
+	// key without their values colliding. They start with a NUL byte
+	// like those of memstore so that they can be told apart from keys.
+	windowKeySuffix = "\x00w"
+	leaseKeySuffix  = "\x00l"
+
 	redisCASMissingKey = "key does not exist"
 	redisCASScript     = `
 local v = redis.call('get', KEYS[1])
@@ -21,6 +31,125 @@ if v ~= ARGV[1] then
 end
 redis.call('setex', KEYS[1], ARGV[3], ARGV[2])
 return 1
+`
+
+	// redisGCRAScript evaluates a GCRA update server-side. Lua numbers
+	// are doubles, which can't hold nanoseconds since the epoch exactly,
+	// so times are split into microseconds and a nanosecond remainder.
+	redisGCRAScript = `
+redis.replicate_commands()
+local function split(s)
+  local n = string.len(s)
+  if n <= 3 then
+    return 0, tonumber(s)
+  end
+  return tonumber(string.sub(s, 1, n - 3)), tonumber(string.sub(s, n - 2))
+end
+local function add(aus, ans, bus, bns)
+  local us, ns = aus + bus, ans + bns
+  if ns >= 1000 then
+    return us + 1, ns - 1000
+  end
+  return us, ns
+end
+local t = redis.call('time')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local v = redis.call('get', KEYS[1])
+local tatus, tatns = now, 0
+if v then
+  tatus, tatns = split(v)
+end
+if tatus < now then
+  tatus, tatns = now, 0
+end
+local incus, incns = split(ARGV[1])
+local newus, newns = add(tatus, tatns, incus, incns)
+local allus, allns = split(ARGV[2])
+local maxus, maxns = add(now, 0, allus, allns)
+if newus > maxus or (newus == maxus and newns > maxns) then
+  return {v or '-1', t[1], t[2], 0}
+end
+local ttl = math.floor((newus - now) / 1000000)
+if ttl < 1 then
+  ttl = 1
+end
+redis.call('set', KEYS[1], string.format('%d%03d', newus, newns), 'EX', ttl)
+return {v or '-1', t[1], t[2], 1}
+`
+
+	// redisWindowScript increments the counter of the current window,
+	// stored as a field of a hash named after the key along with the
+	// counter of the previous window, and drops older windows. Times are
+	// in microseconds.
+	redisWindowScript = `
+redis.replicate_commands()
+local t = redis.call('time')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local window = tonumber(ARGV[1])
+local cur = string.format('%d', now - (now % window))
+local prev = string.format('%d', now - (now % window) - window)
+local c
+if ARGV[2] ~= '0' then
+  c = redis.call('hincrby', KEYS[1], cur, ARGV[2])
+  for _, f in ipairs(redis.call('hkeys', KEYS[1])) do
+    if f ~= cur and f ~= prev then
+      redis.call('hdel', KEYS[1], f)
+    end
+  end
+  redis.call('pexpire', KEYS[1], math.ceil(2 * window / 1000))
+else
+  c = tonumber(redis.call('hget', KEYS[1], cur) or '0')
+end
+local p = tonumber(redis.call('hget', KEYS[1], prev) or '0')
+return {c, p, t[1], t[2]}
+`
+
+	// redisLeaseScript adds a lease to a sorted set of leases scored by
+	// their expiry in milliseconds if there is room after removing the
+	// expired ones. The expiry of the set is only ever raised, so that
+	// it outlives all of its leases.
+	redisLeaseScript = `
+redis.replicate_commands()
+local t = redis.call('time')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+redis.call('zremrangebyscore', KEYS[1], '-inf', now)
+local n = redis.call('zcard', KEYS[1])
+if n >= tonumber(ARGV[2]) then
+  return {0, n}
+end
+local ttl = tonumber(ARGV[3])
+redis.call('zadd', KEYS[1], now + ttl, ARGV[1])
+if redis.call('pttl', KEYS[1]) < ttl then
+  redis.call('pexpire', KEYS[1], ttl)
+end
+return {1, n + 1}
+`
+
+	// redisExtendLeaseScript moves the expiry of a lease that hasn't
+	// expired yet, extending the expiry of the sorted set if needed.
+	redisExtendLeaseScript = `
+redis.replicate_commands()
+local t = redis.call('time')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local exp = redis.call('zscore', KEYS[1], ARGV[1])
+if not exp or tonumber(exp) <= now then
+  return 0
+end
+local ttl = tonumber(ARGV[2])
+redis.call('zadd', KEYS[1], 'xx', now + ttl, ARGV[1])
+if redis.call('pttl', KEYS[1]) < ttl then
+  redis.call('pexpire', KEYS[1], ttl)
+end
+return 1
+`
+
+	// redisWindowRollbackScript adds to the counter of a window only if
+	// it still exists.
+	redisWindowRollbackScript = `
+if redis.call('hexists', KEYS[1], ARGV[1]) == 1 then
+  redis.call('hincrby', KEYS[1], ARGV[1], ARGV[2])
+end
+return 0
 `
 )
 
@@ -126,3 +255,235 @@ func (r *GoRedisStore) CompareAndSwapWithTTL(ctx context.Context, key string, ol
 
 	return swapped, nil
 }
+
+// AdvanceWithTime atomically evaluates a GCRA update for key in a
+// single round trip using a Lua script, which makes the store usable
+// as a throttled.GCRAStoreAtomicCtx. It returns the previous value of
+// the key or -1 if it did not exist, the current time at the redis
+// server to microsecond precision and whether the new value was
+// stored. Depends on Redis 3.2+ for script effects replication.
+func (r *GoRedisStore) AdvanceWithTime(ctx context.Context, key string, increment, allowance time.Duration) (int64, time.Time, bool, error) {
+	key = r.prefix + key
+
+	result, err := r.client.Eval(ctx, redisGCRAScript, []string{key}, int64(increment), int64(allowance)).Result()
+	if err != nil {
+		return 0, time.Time{}, false, err
+	}
+
+	return parseGCRAReply(result)
+}
+
+// Delete removes all state stored for key, including its window
+// counters and leases, which makes GoRedisStore usable as a
+// throttled.StoreAdminCtx. The keys are deleted separately as they may
+// belong to different slots of a Redis Cluster.
+func (r *GoRedisStore) Delete(ctx context.Context, key string) error {
+	key = r.prefix + key
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, k := range []string{key, key + windowKeySuffix, key + leaseKeySuffix} {
+			pipe.Del(ctx, k)
+		}
+		return nil
+	})
+	return err
+}
+
+// Keys returns the keys in the store starting with prefix, in no
+// particular order, without the key prefix of the store. It uses SCAN
+// on every master node when the client is a Redis Cluster client.
+func (r *GoRedisStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	pattern := escapeGlob(r.prefix+prefix) + "*"
+
+	var mu sync.Mutex
+	seen := make(map[string]struct{})
+	keys := []string{}
+
+	scan := func(ctx context.Context, client redis.Cmdable) error {
+		iter := client.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			// SCAN may return a key more than once, and the window
+			// counters and leases of a key are listed under it
+			k := strings.TrimPrefix(iter.Val(), r.prefix)
+			k = strings.TrimSuffix(strings.TrimSuffix(k, windowKeySuffix), leaseKeySuffix)
+			mu.Lock()
+			if !contains(seen, k) {
+				seen[k] = struct{}{}
+				keys = append(keys, k)
+			}
+			mu.Unlock()
+		}
+		return iter.Err()
+	}
+
+	var err error
+	if cluster, ok := r.client.(*redis.ClusterClient); ok {
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return scan(ctx, client)
+		})
+	} else {
+		err = scan(ctx, r.client)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// parseGCRAReply converts the reply of redisGCRAScript into the return
+// values of AdvanceWithTime.
+func parseGCRAReply(reply interface{}) (int64, time.Time, bool, error) {
+	var now time.Time
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 4 {
+		return 0, now, false, fmt.Errorf("unexpected reply from GCRA script: %v", reply)
+	}
+
+	var ints [3]int64
+	for i := range ints {
+		s, ok := values[i].(string)
+		if !ok {
+			return 0, now, false, fmt.Errorf("unexpected reply from GCRA script: %v", reply)
+		}
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, now, false, err
+		}
+		ints[i] = v
+	}
+	advanced, ok := values[3].(int64)
+	if !ok {
+		return 0, now, false, fmt.Errorf("unexpected reply from GCRA script: %v", reply)
+	}
+
+	now = time.Unix(ints[1], ints[2]*int64(time.Microsecond))
+	return ints[0], now, advanced == 1, nil
+}
+
+// IncrementWithTime atomically adds delta to the counter for key in
+// the window of the given size containing the current time at the
+// redis server, which makes the store usable as a
+// throttled.WindowStoreCtx. It returns the new value of that counter,
+// the value of the counter for the previous window and the current
+// time at the redis server to microsecond precision. Windows are
+// truncated to whole microseconds.
+func (r *GoRedisStore) IncrementWithTime(ctx context.Context, key string, window time.Duration, delta int64) (int64, int64, time.Time, error) {
+	var now time.Time
+
+	key = r.prefix + key + windowKeySuffix
+
+	result, err := r.client.Eval(ctx, redisWindowScript, []string{key}, window.Microseconds(), delta).Result()
+	if err != nil {
+		return 0, 0, now, err
+	}
+
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 4 {
+		return 0, 0, now, fmt.Errorf("unexpected reply from window script: %v", result)
+	}
+
+	cur, ok1 := values[0].(int64)
+	prev, ok2 := values[1].(int64)
+	s, ok3 := values[2].(string)
+	us, ok4 := values[3].(string)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return 0, 0, now, fmt.Errorf("unexpected reply from window script: %v", result)
+	}
+
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, 0, now, err
+	}
+	usec, err := strconv.ParseInt(us, 10, 64)
+	if err != nil {
+		return 0, 0, now, err
+	}
+	now = time.Unix(sec, usec*int64(time.Microsecond))
+
+	return cur, prev, now, nil
+}
+
+// IncrementAt atomically adds delta to the counter for key in the
+// window of the given size containing at, if the counter still exists.
+func (r *GoRedisStore) IncrementAt(ctx context.Context, key string, window time.Duration, at time.Time, delta int64) error {
+	key = r.prefix + key + windowKeySuffix
+
+	us := at.UnixNano() / int64(time.Microsecond)
+	start := us - us%window.Microseconds()
+
+	return r.client.Eval(ctx, redisWindowRollbackScript, []string{key}, start, delta).Err()
+}
+
+// AcquireLease atomically removes the expired leases for key and, if
+// fewer than limit leases remain, adds a lease identified by id that
+// expires after ttl rounded down to the millisecond, which makes the
+// store usable as a throttled.ConcurrencyStoreCtx. Leases are kept in a
+// sorted set that expires along with the most recently added lease.
+func (r *GoRedisStore) AcquireLease(ctx context.Context, key, id string, limit int, ttl time.Duration) (bool, int, error) {
+	key = r.prefix + key + leaseKeySuffix
+
+	ttlMillis := ttl.Milliseconds()
+	if ttlMillis < 1 {
+		ttlMillis = 1
+	}
+
+	result, err := r.client.Eval(ctx, redisLeaseScript, []string{key}, id, limit, ttlMillis).Result()
+	if err != nil {
+		return false, 0, err
+	}
+
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, fmt.Errorf("unexpected reply from lease script: %v", result)
+	}
+	acquired, ok1 := values[0].(int64)
+	held, ok2 := values[1].(int64)
+	if !ok1 || !ok2 {
+		return false, 0, fmt.Errorf("unexpected reply from lease script: %v", result)
+	}
+
+	return acquired == 1, int(held), nil
+}
+
+// ReleaseLease removes the lease identified by id for key.
+func (r *GoRedisStore) ReleaseLease(ctx context.Context, key, id string) error {
+	key = r.prefix + key + leaseKeySuffix
+	return r.client.ZRem(ctx, key, id).Err()
+}
+
+// ExtendLease sets the lease identified by id for key to expire after
+// ttl rounded down to the millisecond if it hasn't expired yet. It
+// returns whether the lease was extended.
+func (r *GoRedisStore) ExtendLease(ctx context.Context, key, id string, ttl time.Duration) (bool, error) {
+	key = r.prefix + key + leaseKeySuffix
+
+	ttlMillis := ttl.Milliseconds()
+	if ttlMillis < 1 {
+		ttlMillis = 1
+	}
+
+	extended, err := r.client.Eval(ctx, redisExtendLeaseScript, []string{key}, id, ttlMillis).Int64()
+	if err != nil {
+		return false, err
+	}
+	return extended == 1, nil
+}
+
+func contains(set map[string]struct{}, k string) bool {
+	_, ok := set[k]
+	return ok
+}
+
+// escapeGlob escapes the characters of s that have a special meaning
+// in the glob-style patterns of Redis.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
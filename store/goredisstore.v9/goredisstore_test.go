@@ -52,6 +52,11 @@ func TestRedisStore(t *testing.T) {
 	clearRedis(c)
 	storetest.TestGCRAStoreCtx(t, st)
 	storetest.TestGCRAStoreTTLCtx(t, st)
+	storetest.TestGCRAStoreAtomicCtx(t, st)
+	storetest.TestWindowStoreCtx(t, st)
+	storetest.TestConcurrencyStoreCtx(t, st)
+	storetest.TestSharedKeyCtx(t, st)
+	storetest.TestStoreAdminCtx(t, st)
 }
 
 func BenchmarkRedisStore(b *testing.B) {
@@ -3,6 +3,7 @@ package memstore // import "github.com/throttled/throttled/v2/store/memstore"
 
 import (
 	"github.com/throttled/throttled/v2"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -120,6 +121,44 @@ func (ms *MemStore) CompareAndSwapWithTTL(key string, old, new int64, _ time.Dur
 	return atomic.CompareAndSwapInt64(valP, old, new), nil
 }
 
+// Delete removes key from the store, which makes MemStore usable as a
+// throttled.StoreAdminCtx once wrapped with WrapStoreWithContext.
+func (ms *MemStore) Delete(key string) error {
+	if ms.keys != nil {
+		ms.keys.Remove(key)
+		return nil
+	}
+
+	ms.Lock()
+	defer ms.Unlock()
+	delete(ms.m, key)
+	return nil
+}
+
+// Keys returns the keys in the store starting with prefix, in no
+// particular order.
+func (ms *MemStore) Keys(prefix string) ([]string, error) {
+	var keys []string
+
+	if ms.keys != nil {
+		for _, k := range ms.keys.Keys() {
+			if key := k.(string); strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		return keys, nil
+	}
+
+	ms.RLock()
+	defer ms.RUnlock()
+	for key := range ms.m {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
 func (ms *MemStore) get(key string, locked bool) (*int64, bool) {
 	var valP *int64
 	var ok bool
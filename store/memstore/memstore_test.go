@@ -1,7 +1,11 @@
 package memstore_test
 
 import (
+	"context"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/throttled/throttled/v2/store/memstore"
 	"github.com/throttled/throttled/v2/store/storetest"
@@ -13,6 +17,7 @@ func TestMemStoreLRU(t *testing.T) {
 		t.Fatal(err)
 	}
 	storetest.TestGCRAStoreCtx(t, st)
+	storetest.TestStoreAdminCtx(t, st)
 }
 
 func TestMemStoreUnlimited(t *testing.T) {
@@ -21,6 +26,7 @@ func TestMemStoreUnlimited(t *testing.T) {
 		t.Fatal(err)
 	}
 	storetest.TestGCRAStoreCtx(t, st)
+	storetest.TestStoreAdminCtx(t, st)
 }
 
 func BenchmarkMemStoreLRU(b *testing.B) {
@@ -38,3 +44,97 @@ func BenchmarkMemStoreUnlimited(b *testing.B) {
 	}
 	storetest.BenchmarkGCRAStoreCtx(b, st)
 }
+
+func TestShardedStore(t *testing.T) {
+	st, err := memstore.NewShardedCtx(16, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	storetest.TestGCRAStoreCtx(t, st)
+	storetest.TestGCRAStoreTTLCtx(t, st)
+	storetest.TestWindowStoreCtx(t, st)
+	storetest.TestConcurrencyStoreCtx(t, st)
+	storetest.TestSharedKeyCtx(t, st)
+	storetest.TestStoreAdminCtx(t, st)
+}
+
+func TestShardedStoreEviction(t *testing.T) {
+	st, err := memstore.NewShardedCtx(4, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	var clock int64
+	st.SetTimeNow(func() time.Time { return time.Unix(0, atomic.LoadInt64(&clock)) })
+
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		if _, err := st.SetIfNotExistsWithTTL(ctx, strconv.Itoa(i), 1, time.Duration(i+1)*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	atomic.StoreInt64(&clock, int64(5*time.Second))
+	waitForLen(t, st, 5)
+
+	atomic.StoreInt64(&clock, int64(time.Minute))
+	waitForLen(t, st, 0)
+}
+
+func TestShardedStoreDelete(t *testing.T) {
+	st, err := memstore.NewShardedCtx(4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if _, _, _, err := st.IncrementWithTime(ctx, "foo", time.Minute, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := st.AcquireLease(ctx, "foo", "lease", 1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Window counters and leases are listed under the key they belong to
+	keys, err := st.Keys(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "foo" {
+		t.Errorf("expected Keys to return [foo] but got %v", keys)
+	}
+
+	if err := st.Delete(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if n := st.Len(); n != 0 {
+		t.Errorf("expected Delete to remove all state of the key but %d keys remain", n)
+	}
+}
+
+func TestShardedStoreInvalid(t *testing.T) {
+	if _, err := memstore.NewShardedCtx(0, 0); err == nil {
+		t.Error("expected creating a store without shards to fail")
+	}
+}
+
+func waitForLen(t *testing.T, st *memstore.ShardedStore, want int) {
+	deadline := time.Now().Add(time.Second)
+	for st.Len() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d keys after eviction but got %d", want, st.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func BenchmarkShardedStore(b *testing.B) {
+	st, err := memstore.NewShardedCtx(16, time.Minute)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer st.Close()
+	storetest.BenchmarkGCRAStoreCtx(b, st)
+}
@@ -0,0 +1,409 @@
+package memstore
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ShardedStore is an in-memory store implementation for throttled that
+// honors the ttl of each key. Keys are spread over a number of shards,
+// each guarded by its own lock to reduce contention, and expired keys
+// are evicted by a background goroutine until Close is called. Like
+// MemStore, it doesn't share state with other processes.
+type ShardedStore struct {
+	shards  []*shard
+	timeNow atomic.Value // func() time.Time
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+type shard struct {
+	sync.Mutex
+	m      map[string]entry
+	leases map[string]map[string]int64 // Expiry of each lease id by key
+}
+
+// minTTL is the shortest time a key is kept. Like the Redis stores,
+// this makes sure that a key written with a zero ttl can still be read.
+const minTTL = time.Second
+
+type entry struct {
+	value     int64
+	expiresAt int64 // Nanoseconds since the epoch
+}
+
+func (e entry) expired(now int64) bool {
+	return e.expiresAt <= now
+}
+
+// NewShardedCtx initializes a ShardedStore with the given number of
+// shards, which must be greater than zero. Expired keys are evicted
+// every cleanupInterval. If cleanupInterval <= 0, no background
+// goroutine is started and expired keys are only evicted when they
+// are next written.
+func NewShardedCtx(shards int, cleanupInterval time.Duration) (*ShardedStore, error) {
+	if shards <= 0 {
+		return nil, errors.New("number of shards must be greater than zero")
+	}
+
+	ms := &ShardedStore{
+		shards: make([]*shard, shards),
+		stop:   make(chan struct{}),
+	}
+	for i := range ms.shards {
+		ms.shards[i] = &shard{
+			m:      make(map[string]entry),
+			leases: make(map[string]map[string]int64),
+		}
+	}
+	ms.SetTimeNow(time.Now)
+
+	if cleanupInterval > 0 {
+		go ms.janitor(cleanupInterval)
+	}
+
+	return ms, nil
+}
+
+// SetTimeNow makes this store use the given function instead of time.Now().
+// This is useful for unit tests that use a simulated wallclock.
+func (ms *ShardedStore) SetTimeNow(timeNow func() time.Time) {
+	ms.timeNow.Store(timeNow)
+}
+
+// Close stops the background goroutine evicting expired keys. The
+// store remains usable afterwards, but expired keys are only evicted
+// when they are next written.
+func (ms *ShardedStore) Close() error {
+	ms.closeOnce.Do(func() { close(ms.stop) })
+	return nil
+}
+
+// Len returns the number of keys in the store, including expired keys
+// that have not been evicted yet.
+func (ms *ShardedStore) Len() int {
+	n := 0
+	for _, s := range ms.shards {
+		s.Lock()
+		n += len(s.m) + len(s.leases)
+		s.Unlock()
+	}
+	return n
+}
+
+// GetWithTime returns the value of the key if it is in the store and
+// has not expired or -1 if it does not exist. It also returns the
+// current local time on the machine.
+func (ms *ShardedStore) GetWithTime(_ context.Context, key string) (int64, time.Time, error) {
+	now := ms.now()
+	s := ms.shard(key)
+
+	s.Lock()
+	e, ok := s.m[key]
+	s.Unlock()
+
+	if !ok || e.expired(now.UnixNano()) {
+		return -1, now, nil
+	}
+	return e.value, now, nil
+}
+
+// SetIfNotExistsWithTTL sets the value of key only if it is not
+// already set in the store or has expired. It returns whether a new
+// value was set. The key expires after ttl, or one second if ttl is
+// shorter than that.
+func (ms *ShardedStore) SetIfNotExistsWithTTL(_ context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	now := ms.now().UnixNano()
+	s := ms.shard(key)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if e, ok := s.m[key]; ok && !e.expired(now) {
+		return false, nil
+	}
+
+	s.m[key] = entry{value: value, expiresAt: expiresAt(now, ttl)}
+	return true, nil
+}
+
+// CompareAndSwapWithTTL atomically compares the value at key to the
+// old value. If it matches, it sets it to the new value and returns
+// true. Otherwise, it returns false. If the key does not exist in the
+// store or has expired, it returns false with no error. If the swap
+// succeeds, the key expires after ttl, or one second if ttl is shorter
+// than that.
+func (ms *ShardedStore) CompareAndSwapWithTTL(_ context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	now := ms.now().UnixNano()
+	s := ms.shard(key)
+
+	s.Lock()
+	defer s.Unlock()
+
+	e, ok := s.m[key]
+	if !ok || e.expired(now) || e.value != old {
+		return false, nil
+	}
+
+	s.m[key] = entry{value: new, expiresAt: expiresAt(now, ttl)}
+	return true, nil
+}
+
+// IncrementWithTime atomically adds delta to the counter for key in
+// the window of the given size containing the current local time, which
+// makes ShardedStore usable as a throttled.WindowStoreCtx. It returns
+// the new value of that counter, the value of the counter for the
+// previous window and the current time. Counters expire at the end of
+// the window after their own.
+func (ms *ShardedStore) IncrementWithTime(_ context.Context, key string, window time.Duration, delta int64) (int64, int64, time.Time, error) {
+	now := ms.now()
+	start := windowStart(now, window)
+	s := ms.shard(key)
+
+	s.Lock()
+	defer s.Unlock()
+
+	cur := s.counter(windowKey(key, start), now.UnixNano())
+	if delta != 0 {
+		cur += delta
+		s.m[windowKey(key, start)] = entry{value: cur, expiresAt: start + 2*int64(window)}
+	}
+	prev := s.counter(windowKey(key, start-int64(window)), now.UnixNano())
+
+	return cur, prev, now, nil
+}
+
+// IncrementAt atomically adds delta to the counter for key in the
+// window of the given size containing at, if the counter still exists.
+func (ms *ShardedStore) IncrementAt(_ context.Context, key string, window time.Duration, at time.Time, delta int64) error {
+	now := ms.now().UnixNano()
+	k := windowKey(key, windowStart(at, window))
+	s := ms.shard(key)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if e, ok := s.m[k]; ok && !e.expired(now) {
+		e.value += delta
+		s.m[k] = e
+	}
+	return nil
+}
+
+// counter returns the value of the window counter k or 0 if it doesn't
+// exist. The shard must be locked.
+func (s *shard) counter(k string, now int64) int64 {
+	if e, ok := s.m[k]; ok && !e.expired(now) {
+		return e.value
+	}
+	return 0
+}
+
+// AcquireLease atomically removes the expired leases for key and, if
+// fewer than limit leases remain, adds a lease identified by id that
+// expires after ttl, which makes ShardedStore usable as a
+// throttled.ConcurrencyStoreCtx. It returns whether the lease was added
+// and the number of leases held for key afterwards.
+func (ms *ShardedStore) AcquireLease(_ context.Context, key, id string, limit int, ttl time.Duration) (bool, int, error) {
+	now := ms.now().UnixNano()
+	s := ms.shard(key)
+
+	s.Lock()
+	defer s.Unlock()
+
+	leases := s.leases[key]
+	for l, exp := range leases {
+		if exp <= now {
+			delete(leases, l)
+		}
+	}
+
+	if len(leases) >= limit {
+		return false, len(leases), nil
+	}
+
+	if leases == nil {
+		leases = make(map[string]int64)
+		s.leases[key] = leases
+	}
+	leases[id] = now + int64(ttl)
+	return true, len(leases), nil
+}
+
+// ReleaseLease removes the lease identified by id for key.
+func (ms *ShardedStore) ReleaseLease(_ context.Context, key, id string) error {
+	s := ms.shard(key)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if leases, ok := s.leases[key]; ok {
+		delete(leases, id)
+		if len(leases) == 0 {
+			delete(s.leases, key)
+		}
+	}
+	return nil
+}
+
+// ExtendLease sets the lease identified by id for key to expire after
+// ttl if it hasn't expired yet. It returns whether the lease was
+// extended.
+func (ms *ShardedStore) ExtendLease(_ context.Context, key, id string, ttl time.Duration) (bool, error) {
+	now := ms.now().UnixNano()
+	s := ms.shard(key)
+
+	s.Lock()
+	defer s.Unlock()
+
+	leases := s.leases[key]
+	if exp, ok := leases[id]; !ok || exp <= now {
+		return false, nil
+	}
+	leases[id] = now + int64(ttl)
+	return true, nil
+}
+
+// Delete removes all state stored for key, including its window
+// counters and leases, which makes ShardedStore usable as a
+// throttled.StoreAdminCtx.
+func (ms *ShardedStore) Delete(_ context.Context, key string) error {
+	s := ms.shard(key)
+
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.m, key)
+	delete(s.leases, key)
+
+	counters := key + "\x00"
+	for k := range s.m {
+		if strings.HasPrefix(k, counters) {
+			delete(s.m, k)
+		}
+	}
+	return nil
+}
+
+// Keys returns the keys starting with prefix for which unexpired state
+// is stored, in no particular order.
+func (ms *ShardedStore) Keys(_ context.Context, prefix string) ([]string, error) {
+	now := ms.now().UnixNano()
+	seen := make(map[string]struct{})
+
+	for _, s := range ms.shards {
+		s.Lock()
+		for k, e := range s.m {
+			if !e.expired(now) && strings.HasPrefix(k, prefix) {
+				seen[baseKey(k)] = struct{}{}
+			}
+		}
+		for k, leases := range s.leases {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+			for _, exp := range leases {
+				if exp > now {
+					seen[k] = struct{}{}
+					break
+				}
+			}
+		}
+		s.Unlock()
+	}
+
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (ms *ShardedStore) now() time.Time {
+	return ms.timeNow.Load().(func() time.Time)()
+}
+
+// shard returns the shard holding key using the FNV-1a hash of the key.
+func (ms *ShardedStore) shard(key string) *shard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return ms.shards[h%uint32(len(ms.shards))]
+}
+
+func (ms *ShardedStore) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ms.evictExpired()
+		case <-ms.stop:
+			return
+		}
+	}
+}
+
+// evictExpired removes expired keys one shard at a time so that only a
+// fraction of the keys is locked at any point.
+func (ms *ShardedStore) evictExpired() {
+	now := ms.now().UnixNano()
+	for _, s := range ms.shards {
+		s.Lock()
+		for k, e := range s.m {
+			if e.expired(now) {
+				delete(s.m, k)
+			}
+		}
+		for k, leases := range s.leases {
+			for id, exp := range leases {
+				if exp <= now {
+					delete(leases, id)
+				}
+			}
+			if len(leases) == 0 {
+				delete(s.leases, k)
+			}
+		}
+		s.Unlock()
+	}
+}
+
+// windowStart returns the start of the window of the given size
+// containing t in nanoseconds since the epoch.
+func windowStart(t time.Time, window time.Duration) int64 {
+	ns := t.UnixNano()
+	return ns - ns%int64(window)
+}
+
+// windowKey returns the key of the window counter for key starting at
+// start. Window counters are stored in the same shard as key itself so
+// that the counters of consecutive windows can be read together.
+func windowKey(key string, start int64) string {
+	return key + "\x00" + strconv.FormatInt(start, 10)
+}
+
+// baseKey returns the key a stored key belongs to, stripping the
+// window of a window counter.
+func baseKey(k string) string {
+	if i := strings.IndexByte(k, 0); i >= 0 {
+		return k[:i]
+	}
+	return k
+}
+
+func expiresAt(now int64, ttl time.Duration) int64 {
+	if ttl < minTTL {
+		ttl = minTTL
+	}
+	return now + int64(ttl)
+}
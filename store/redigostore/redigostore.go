@@ -21,6 +21,50 @@ if v ~= ARGV[1] then
 end
 redis.call('setex', KEYS[1], ARGV[3], ARGV[2])
 return 1
+`
+
+	// redisGCRAScript evaluates a GCRA update server-side. Lua numbers
+	// are doubles, which can't hold nanoseconds since the epoch exactly,
+	// so times are split into microseconds and a nanosecond remainder.
+	redisGCRAScript = `
+redis.replicate_commands()
+local function split(s)
+  local n = string.len(s)
+  if n <= 3 then
+    return 0, tonumber(s)
+  end
+  return tonumber(string.sub(s, 1, n - 3)), tonumber(string.sub(s, n - 2))
+end
+local function add(aus, ans, bus, bns)
+  local us, ns = aus + bus, ans + bns
+  if ns >= 1000 then
+    return us + 1, ns - 1000
+  end
+  return us, ns
+end
+local t = redis.call('time')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local v = redis.call('get', KEYS[1])
+local tatus, tatns = now, 0
+if v then
+  tatus, tatns = split(v)
+end
+if tatus < now then
+  tatus, tatns = now, 0
+end
+local incus, incns = split(ARGV[1])
+local newus, newns = add(tatus, tatns, incus, incns)
+local allus, allns = split(ARGV[2])
+local maxus, maxns = add(now, 0, allus, allns)
+if newus > maxus or (newus == maxus and newns > maxns) then
+  return {v or '-1', t[1], t[2], 0}
+end
+local ttl = math.floor((newus - now) / 1000000)
+if ttl < 1 then
+  ttl = 1
+end
+redis.call('set', KEYS[1], string.format('%d%03d', newus, newns), 'EX', ttl)
+return {v or '-1', t[1], t[2], 1}
 `
 )
 
@@ -167,6 +211,105 @@ func (r *RedigoStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time
 	return swapped, nil
 }
 
+// AdvanceWithTime atomically evaluates a GCRA update for key in a
+// single round trip using a Lua script, which makes the store usable
+// as a throttled.GCRAStoreAtomicCtx. It returns the previous value of
+// the key or -1 if it did not exist, the current time at the redis
+// server to microsecond precision and whether the new value was
+// stored. Depends on Redis 3.2+ for script effects replication.
+func (r *RedigoStore) AdvanceWithTime(key string, increment, allowance time.Duration) (int64, time.Time, bool, error) {
+	var now time.Time
+
+	key = r.prefix + key
+
+	conn, err := r.getConn()
+	if err != nil {
+		return 0, now, false, err
+	}
+	defer conn.Close()
+
+	reply, err := redis.Values(conn.Do("EVAL", redisGCRAScript, 1, key, int64(increment), int64(allowance)))
+	if err != nil {
+		return 0, now, false, err
+	}
+
+	var v, s, us, advanced int64
+	if _, err := redis.Scan(reply, &v, &s, &us, &advanced); err != nil {
+		return 0, now, false, err
+	}
+	now = time.Unix(s, us*int64(time.Microsecond))
+
+	return v, now, advanced == 1, nil
+}
+
+// Delete removes key from the store, which makes RedigoStore usable as
+// a throttled.StoreAdminCtx once wrapped with WrapStoreWithContext.
+func (r *RedigoStore) Delete(key string) error {
+	conn, err := r.getConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("DEL", r.prefix+key)
+	return err
+}
+
+// Keys returns the keys in the store starting with prefix, in no
+// particular order, without the key prefix of the store. It uses SCAN,
+// so with a Redis Cluster only the keys of the node the pool connects
+// to are returned.
+func (r *RedigoStore) Keys(prefix string) ([]string, error) {
+	conn, err := r.getConn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	pattern := escapeGlob(r.prefix+prefix) + "*"
+	seen := make(map[string]struct{})
+	keys := []string{}
+
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 100))
+		if err != nil {
+			return nil, err
+		}
+
+		var batch []string
+		if _, err := redis.Scan(reply, &cursor, &batch); err != nil {
+			return nil, err
+		}
+
+		// SCAN may return a key more than once
+		for _, k := range batch {
+			if _, ok := seen[k]; !ok {
+				seen[k] = struct{}{}
+				keys = append(keys, strings.TrimPrefix(k, r.prefix))
+			}
+		}
+
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
+// escapeGlob escapes the characters of s that have a special meaning
+// in the glob-style patterns of Redis.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
 // Select the specified database index.
 func (r *RedigoStore) getConn() (redis.Conn, error) {
 	conn := r.pool.Get()
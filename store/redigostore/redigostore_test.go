@@ -39,6 +39,8 @@ func TestRedisStore(t *testing.T) {
 	clearRedis(c)
 	storetest.TestGCRAStoreCtx(t, st)
 	storetest.TestGCRAStoreTTLCtx(t, st)
+	storetest.TestGCRAStoreAtomicCtx(t, st.(throttled.GCRAStoreAtomicCtx))
+	storetest.TestStoreAdminCtx(t, st)
 }
 
 func BenchmarkRedisStore(b *testing.B) {
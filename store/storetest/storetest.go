@@ -4,6 +4,8 @@ package storetest // import "github.com/throttled/throttled/v2/store/storetest"
 import (
 	"context"
 	"math/rand"
+	"reflect"
+	"sort"
 	"strconv"
 	"sync/atomic"
 	"testing"
@@ -135,6 +137,344 @@ func TestGCRAStoreTTLCtx(t *testing.T, st throttled.GCRAStoreCtx) {
 	}
 }
 
+// TestGCRAStoreAtomicCtx tests the behavior of a GCRAStoreAtomicCtx
+// implementation for compliance with the throttled API.
+func TestGCRAStoreAtomicCtx(t *testing.T, st throttled.GCRAStoreAtomicCtx) {
+	ctx := context.Background()
+	key := "atomic"
+	// Use an increment with a sub-microsecond part to make sure the
+	// store doesn't lose precision
+	increment := time.Second + 999*time.Nanosecond
+	allowance := 2*time.Second + 500*time.Millisecond
+
+	// AdvanceWithTime on a missing key starts from the current time
+	prev, now, advanced, err := st.AdvanceWithTime(ctx, key, increment, allowance)
+	if err != nil {
+		t.Fatal(err)
+	} else if prev != -1 {
+		t.Errorf("expected AdvanceWithTime to return -1 for a missing key but got %d", prev)
+	} else if !advanced {
+		t.Errorf("expected AdvanceWithTime on a missing key to succeed")
+	}
+
+	want := now.Add(increment).UnixNano()
+	if have, _, err := st.GetWithTime(ctx, key); err != nil {
+		t.Fatal(err)
+	} else if have != want {
+		t.Errorf("expected GetWithTime to return %d but got %d", want, have)
+	}
+
+	// AdvanceWithTime on a value in the future adds to that value
+	if prev, _, advanced, err := st.AdvanceWithTime(ctx, key, increment, allowance); err != nil {
+		t.Fatal(err)
+	} else if prev != want {
+		t.Errorf("expected AdvanceWithTime to return %d but got %d", want, prev)
+	} else if !advanced {
+		t.Errorf("expected AdvanceWithTime within the allowance to succeed")
+	}
+
+	want += int64(increment)
+	if have, _, err := st.GetWithTime(ctx, key); err != nil {
+		t.Fatal(err)
+	} else if have != want {
+		t.Errorf("expected GetWithTime to return %d but got %d", want, have)
+	}
+
+	// AdvanceWithTime beyond the allowance leaves the value unchanged
+	if prev, _, advanced, err := st.AdvanceWithTime(ctx, key, increment, allowance); err != nil {
+		t.Fatal(err)
+	} else if prev != want {
+		t.Errorf("expected AdvanceWithTime to return %d but got %d", want, prev)
+	} else if advanced {
+		t.Errorf("expected AdvanceWithTime beyond the allowance to fail")
+	}
+
+	if have, _, err := st.GetWithTime(ctx, key); err != nil {
+		t.Fatal(err)
+	} else if have != want {
+		t.Errorf("expected GetWithTime to return %d but got %d", want, have)
+	}
+}
+
+// TestWindowStoreCtx tests the behavior of a WindowStoreCtx
+// implementation for compliance with the throttled API.
+func TestWindowStoreCtx(t *testing.T, st throttled.WindowStoreCtx) {
+	ctx := context.Background()
+	key := "window"
+	// Use a window long enough that the test doesn't cross into the next
+	window := time.Hour
+
+	// Incrementing a missing counter starts from zero
+	if cur, prev, now, err := st.IncrementWithTime(ctx, key, window, 2); err != nil {
+		t.Fatal(err)
+	} else if cur != 2 || prev != 0 {
+		t.Errorf("expected IncrementWithTime to return 2, 0 but got %d, %d", cur, prev)
+	} else if now.UnixNano() <= 0 {
+		t.Errorf("expected IncrementWithTime to return a time representable as a positive int64 of nanoseconds since the epoch")
+	}
+
+	if cur, _, _, err := st.IncrementWithTime(ctx, key, window, 3); err != nil {
+		t.Fatal(err)
+	} else if cur != 5 {
+		t.Errorf("expected IncrementWithTime to return 5 but got %d", cur)
+	}
+
+	// A delta of 0 only reads the counter
+	cur, _, now, err := st.IncrementWithTime(ctx, key, window, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if cur != 5 {
+		t.Errorf("expected IncrementWithTime to return 5 but got %d", cur)
+	}
+
+	// IncrementAt updates the existing counter of the window
+	if err := st.IncrementAt(ctx, key, window, now, -3); err != nil {
+		t.Fatal(err)
+	}
+	if cur, _, _, err := st.IncrementWithTime(ctx, key, window, 0); err != nil {
+		t.Fatal(err)
+	} else if cur != 2 {
+		t.Errorf("expected IncrementWithTime to return 2 after IncrementAt but got %d", cur)
+	}
+
+	// IncrementAt doesn't create counters
+	if err := st.IncrementAt(ctx, key, window, now.Add(window), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.IncrementAt(ctx, "missing", window, now, 1); err != nil {
+		t.Fatal(err)
+	}
+	if cur, _, _, err := st.IncrementWithTime(ctx, "missing", window, 0); err != nil {
+		t.Fatal(err)
+	} else if cur != 0 {
+		t.Errorf("expected IncrementAt not to create a counter but got %d", cur)
+	}
+
+	// A shorter window on a different key sees the counter of the
+	// previous window once it has passed
+	shortKey := "window-short"
+	short := 100 * time.Millisecond
+	if _, _, now, err := st.IncrementWithTime(ctx, shortKey, short, 1); err != nil {
+		t.Fatal(err)
+	} else {
+		time.Sleep(short - time.Duration(now.UnixNano()%int64(short)))
+	}
+	if cur, prev, _, err := st.IncrementWithTime(ctx, shortKey, short, 0); err != nil {
+		t.Fatal(err)
+	} else if cur != 0 || prev != 1 {
+		t.Errorf("expected IncrementWithTime to return 0, 1 in the next window but got %d, %d", cur, prev)
+	}
+}
+
+// TestConcurrencyStoreCtx tests the behavior of a ConcurrencyStoreCtx
+// implementation for compliance with the throttled API.
+func TestConcurrencyStoreCtx(t *testing.T, st throttled.ConcurrencyStoreCtx) {
+	ctx := context.Background()
+	key := "leases"
+	limit := 2
+
+	acquire := func(key, id string, ttl time.Duration, wantAcquired bool, wantHeld int) {
+		t.Helper()
+		if acquired, held, err := st.AcquireLease(ctx, key, id, limit, ttl); err != nil {
+			t.Fatal(err)
+		} else if acquired != wantAcquired || held != wantHeld {
+			t.Errorf("expected AcquireLease of %s to return %t, %d but got %t, %d",
+				id, wantAcquired, wantHeld, acquired, held)
+		}
+	}
+
+	acquire(key, "a", time.Hour, true, 1)
+	acquire(key, "b", time.Hour, true, 2)
+	acquire(key, "c", time.Hour, false, 2)
+
+	// Releasing a lease makes room for another
+	if err := st.ReleaseLease(ctx, key, "a"); err != nil {
+		t.Fatal(err)
+	}
+	acquire(key, "c", time.Hour, true, 2)
+
+	// Releasing a missing lease is not an error
+	if err := st.ReleaseLease(ctx, key, "missing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.ReleaseLease(ctx, "missing", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired leases don't count against the limit
+	ttl := 50 * time.Millisecond
+	acquire("leases-ttl", "a", ttl, true, 1)
+	acquire("leases-ttl", "b", ttl, true, 2)
+	time.Sleep(ttl + 10*time.Millisecond)
+	acquire("leases-ttl", "c", time.Hour, true, 1)
+
+	// Short leases don't cut longer ones short
+	if acquired, _, err := st.AcquireLease(ctx, "leases-mixed", "a", limit, time.Hour); err != nil || !acquired {
+		t.Fatalf("expected AcquireLease of a to succeed but got %t, %v", acquired, err)
+	}
+	acquire("leases-mixed", "b", ttl, true, 2)
+	time.Sleep(ttl + 10*time.Millisecond)
+	acquire("leases-mixed", "c", time.Hour, true, 2)
+
+	// Extended leases keep their slot past their original expiry
+	extend := func(key, id string, ttl time.Duration, want bool) {
+		t.Helper()
+		if extended, err := st.ExtendLease(ctx, key, id, ttl); err != nil {
+			t.Fatal(err)
+		} else if extended != want {
+			t.Errorf("expected ExtendLease of %s to return %t but got %t", id, want, extended)
+		}
+	}
+	acquire("leases-extend", "a", ttl, true, 1)
+	acquire("leases-extend", "b", ttl, true, 2)
+	extend("leases-extend", "a", time.Hour, true)
+	time.Sleep(ttl + 10*time.Millisecond)
+	acquire("leases-extend", "c", time.Hour, true, 2)
+	acquire("leases-extend", "d", time.Hour, false, 2)
+
+	// Expired and missing leases can't be extended
+	extend("leases-extend", "b", time.Hour, false)
+	extend("leases-extend", "missing", time.Hour, false)
+	extend("missing", "a", time.Hour, false)
+}
+
+// TestStoreAdminCtx tests the administrative operations of a store
+// that implements throttled.StoreAdminCtx in addition to
+// throttled.GCRAStoreCtx.
+func TestStoreAdminCtx(t *testing.T, st throttled.GCRAStoreCtx) {
+	admin, ok := st.(throttled.StoreAdminCtx)
+	if !ok {
+		t.Fatalf("expected %T to implement StoreAdminCtx", st)
+	}
+
+	ctx := context.Background()
+	// The last key contains glob characters that must be matched literally
+	keys := []string{"admin:1", "admin:2", "admin:x*", "adminx"}
+	for _, key := range keys {
+		if err := admin.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := st.SetIfNotExistsWithTTL(ctx, key, 1, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"admin:", []string{"admin:1", "admin:2", "admin:x*"}},
+		{"admin:x*", []string{"admin:x*"}},
+		{"admin:y", []string{}},
+	} {
+		have, err := admin.Keys(ctx, c.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(have)
+		if len(have) != len(c.want) || len(have) > 0 && !reflect.DeepEqual(have, c.want) {
+			t.Errorf("expected Keys(%q) to return %v but got %v", c.prefix, c.want, have)
+		}
+	}
+
+	if err := admin.Delete(ctx, "admin:1"); err != nil {
+		t.Fatal(err)
+	}
+	if have, _, err := st.GetWithTime(ctx, "admin:1"); err != nil {
+		t.Fatal(err)
+	} else if have != -1 {
+		t.Errorf("expected GetWithTime to return -1 for a deleted key but got %d", have)
+	}
+	if have, _, err := st.GetWithTime(ctx, "admin:2"); err != nil {
+		t.Fatal(err)
+	} else if have != 1 {
+		t.Errorf("expected Delete to leave other keys but GetWithTime returned %d", have)
+	}
+
+	// Deleting a missing key is not an error
+	if err := admin.Delete(ctx, "admin:1"); err != nil {
+		t.Errorf("expected deleting a missing key to succeed but got %v", err)
+	}
+
+	for _, key := range keys {
+		if err := admin.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestSharedKeyCtx tests that the state of GCRA, window and concurrency
+// limiters using the same key in a store doesn't collide. If the store
+// implements throttled.StoreAdminCtx, it also tests that the key is
+// listed once and that deleting it removes all of its state.
+func TestSharedKeyCtx(t *testing.T, st interface {
+	throttled.GCRAStoreCtx
+	throttled.WindowStoreCtx
+	throttled.ConcurrencyStoreCtx
+}) {
+	ctx := context.Background()
+	key := "shared"
+
+	if _, err := st.SetIfNotExistsWithTTL(ctx, key, 1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := st.IncrementWithTime(ctx, key, time.Minute, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := st.AcquireLease(ctx, key, "a", 1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if have, _, err := st.GetWithTime(ctx, key); err != nil {
+		t.Fatal(err)
+	} else if have != 1 {
+		t.Errorf("expected GetWithTime to return 1 but got %d", have)
+	}
+	if cur, _, _, err := st.IncrementWithTime(ctx, key, time.Minute, 0); err != nil {
+		t.Fatal(err)
+	} else if cur != 2 {
+		t.Errorf("expected IncrementWithTime to return 2 but got %d", cur)
+	}
+	if acquired, held, err := st.AcquireLease(ctx, key, "b", 1, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if acquired || held != 1 {
+		t.Errorf("expected AcquireLease to return false, 1 but got %t, %d", acquired, held)
+	}
+
+	admin, ok := st.(throttled.StoreAdminCtx)
+	if !ok {
+		return
+	}
+
+	if have, err := admin.Keys(ctx, key); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(have, []string{key}) {
+		t.Errorf("expected Keys to return %v but got %v", []string{key}, have)
+	}
+
+	if err := admin.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if have, _, err := st.GetWithTime(ctx, key); err != nil {
+		t.Fatal(err)
+	} else if have != -1 {
+		t.Errorf("expected GetWithTime to return -1 after Delete but got %d", have)
+	}
+	if cur, _, _, err := st.IncrementWithTime(ctx, key, time.Minute, 0); err != nil {
+		t.Fatal(err)
+	} else if cur != 0 {
+		t.Errorf("expected IncrementWithTime to return 0 after Delete but got %d", cur)
+	}
+	if acquired, _, err := st.AcquireLease(ctx, key, "b", 1, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if !acquired {
+		t.Error("expected AcquireLease to succeed after Delete")
+	}
+	if err := admin.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // BenchmarkGCRAStoreCtx runs parallel benchmarks against a GCRAStore implementation.
 // Aside from being useful for performance testing, this is useful for finding
 // race conditions with the Go race detector.
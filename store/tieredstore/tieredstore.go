@@ -0,0 +1,488 @@
+// Package tieredstore offers a store implementation for throttled that
+// keeps a local copy of the state of another store, such as a Redis
+// store, and synchronizes it in the background.
+package tieredstore // import "github.com/throttled/throttled/v2/store/tieredstore"
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/throttled/throttled/v2"
+)
+
+// TieredStore is a GCRAStoreCtx that serves reads and updates from a
+// local copy of the keys of a backing store, which is typically shared
+// by several processes, so that most rate limiting decisions don't
+// wait for the backing store.
+//
+// A key is loaded from the backing store when it is first used. The
+// updates made to it locally are then sent to the backing store every
+// syncInterval, merged with the updates of other processes, and the
+// merged state is loaded back. Keys that have not been used since the
+// previous synchronization are dropped from the local copy, so that
+// they are loaded again when next used.
+//
+// Decisions are therefore made against a state that lacks the updates
+// other processes made since the last synchronization. A request that
+// is limited locally would also have been limited by the backing store,
+// but more requests than the limit permits may be admitted: each
+// process admits requests worth at most maxError of theoretical arrival
+// time (see GCRARateLimiterCtx) per key before it synchronizes the key
+// immediately. For example, with a quota of 10 requests per second and
+// a maxError of one second, 3 processes may together admit up to 30
+// requests more than the quota per synchronization interval.
+//
+// Like the other stores, TieredStore assumes that the clocks of all
+// processes and the backing store are synchronized.
+type TieredStore struct {
+	backing      throttled.GCRAStoreCtx
+	maxError     int64
+	syncInterval time.Duration
+
+	mu   sync.Mutex
+	keys map[string]*entry
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type entry struct {
+	// syncMu serializes the synchronizations of the key so that local
+	// updates are only sent once. The other fields are protected by the
+	// mu of the store.
+	syncMu sync.Mutex
+
+	// value is the local value of the key or -1 if it doesn't exist.
+	value int64
+
+	// remote is the value of the key in the backing store when it was
+	// last loaded or synchronized, and loaded is the time of the backing
+	// store in UnixNano at that point.
+	remote, loaded int64
+
+	// pending is the time the value was advanced by local updates that
+	// have not been sent to the backing store yet, not counting the
+	// time it caught up with the current time.
+	pending int64
+
+	// updates counts the local updates, and synced is the count at the
+	// last synchronization.
+	updates, synced int
+
+	// used is whether the key was used since the last synchronization.
+	used bool
+}
+
+// NewCtx initializes a TieredStore in front of the backing store. Local
+// updates are synchronized with the backing store every syncInterval
+// by a background goroutine until Close is called, and immediately for
+// a key once they add up to more than maxError. A maxError of 0
+// synchronizes every update immediately.
+//
+// Each key is synchronized on its own, as GCRAStoreCtx has no way to
+// batch requests, so Sync takes one round trip to the backing store per
+// key and another one per key with local updates, or a few more if
+// other processes update it at the same time. Each background
+// synchronization is cancelled through its context after syncInterval,
+// so a backing store that doesn't respond only holds up the keys that
+// are left until the next one.
+func NewCtx(backing throttled.GCRAStoreCtx, syncInterval, maxError time.Duration) (*TieredStore, error) {
+	if backing == nil {
+		return nil, errors.New("a backing store is required")
+	}
+	if syncInterval <= 0 {
+		return nil, errors.New("syncInterval must be greater than zero")
+	}
+	if maxError < 0 {
+		return nil, errors.New("maxError must not be negative")
+	}
+
+	ts := &TieredStore{
+		backing:      backing,
+		maxError:     int64(maxError),
+		syncInterval: syncInterval,
+		keys:         make(map[string]*entry),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go ts.syncer()
+
+	return ts, nil
+}
+
+// GetWithTime returns the local value of the key, loading it from the
+// backing store if it is not present locally, or -1 if it does not
+// exist. It also returns the current local time on the machine.
+func (ts *TieredStore) GetWithTime(ctx context.Context, key string) (int64, time.Time, error) {
+	if err := ts.load(ctx, key); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	ts.mu.Lock()
+	value := ts.keys[key].value
+	ts.mu.Unlock()
+
+	return value, time.Now(), nil
+}
+
+// SetIfNotExistsWithTTL sets the local value of key only if it doesn't
+// exist locally or in the backing store. It returns whether a new value
+// was set. The ttl is applied when the key is synchronized.
+func (ts *TieredStore) SetIfNotExistsWithTTL(ctx context.Context, key string, value int64, _ time.Duration) (bool, error) {
+	return ts.update(ctx, key, -1, value)
+}
+
+// CompareAndSwapWithTTL atomically compares the local value of key to
+// the old value. If it matches, it sets it to the new value and returns
+// true. Otherwise, it returns false. If the key does not exist, it
+// returns false with no error. The ttl is applied when the key is
+// synchronized.
+func (ts *TieredStore) CompareAndSwapWithTTL(ctx context.Context, key string, old, new int64, _ time.Duration) (bool, error) {
+	if old == -1 {
+		return false, nil
+	}
+	return ts.update(ctx, key, old, new)
+}
+
+// update sets the local value of key to new if it is old.
+func (ts *TieredStore) update(ctx context.Context, key string, old, new int64) (bool, error) {
+	if err := ts.load(ctx, key); err != nil {
+		return false, err
+	}
+
+	ts.mu.Lock()
+	e := ts.keys[key]
+	if e == nil || e.value != old {
+		ts.mu.Unlock()
+		return false, nil
+	}
+
+	// Values in the past are equivalent to the current time
+	now := time.Now().UnixNano()
+	advance := maxInt64(new, now) - maxInt64(old, now)
+	exceeds := abs(e.pending+advance) > ts.maxError
+	if exceeds && e.pending != 0 {
+		// The update would exceed the error budget, so synchronize the
+		// key first. The caller then retries with the merged value.
+		ts.mu.Unlock()
+		return false, ts.syncKey(ctx, key)
+	}
+
+	e.value = new
+	e.pending += advance
+	e.updates++
+	e.used = true
+	ts.mu.Unlock()
+
+	// An update exceeding the error budget on its own is synchronized
+	// right away
+	if exceeds || ts.maxError == 0 {
+		return true, ts.syncKey(ctx, key)
+	}
+	return true, nil
+}
+
+// load loads key from the backing store unless it is present locally.
+func (ts *TieredStore) load(ctx context.Context, key string) error {
+	ts.mu.Lock()
+	e, ok := ts.keys[key]
+	if ok {
+		e.used = true
+	}
+	ts.mu.Unlock()
+	if ok {
+		return nil
+	}
+
+	value, now, err := ts.backing.GetWithTime(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	ts.mu.Lock()
+	if _, ok := ts.keys[key]; !ok {
+		ts.keys[key] = &entry{value: value, remote: value, loaded: now.UnixNano(), used: true}
+	}
+	ts.mu.Unlock()
+	return nil
+}
+
+// Sync synchronizes all keys with local updates with the backing store
+// and drops the keys that have not been used since the previous
+// synchronization. It is called periodically by a background goroutine
+// but can also be called directly, for example before shutting down.
+func (ts *TieredStore) Sync(ctx context.Context) error {
+	var keys []string
+	ts.mu.Lock()
+	for key, e := range ts.keys {
+		if e.used || e.updates != e.synced {
+			keys = append(keys, key)
+		} else {
+			delete(ts.keys, key)
+		}
+		e.used = false
+	}
+	ts.mu.Unlock()
+
+	var firstErr error
+	for _, key := range keys {
+		if err := ts.syncKey(ctx, key); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// syncKey sends the local updates of key to the backing store and loads
+// the merged value.
+func (ts *TieredStore) syncKey(ctx context.Context, key string) error {
+	ts.mu.Lock()
+	e, ok := ts.keys[key]
+	ts.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	e.syncMu.Lock()
+	defer e.syncMu.Unlock()
+
+	ts.mu.Lock()
+	value, pending, updates, loaded := e.value, e.pending, e.updates, e.loaded
+	dirty := updates != e.synced
+	ts.mu.Unlock()
+
+	var merged, synced int64
+	var deleted bool
+	for {
+		remote, now, err := ts.backing.GetWithTime(ctx, key)
+		if err != nil {
+			return err
+		}
+		synced = now.UnixNano()
+
+		// The backing store holds the updates of other processes, to
+		// which the local updates are added. The local value already
+		// includes them if no other process updated the key or it
+		// expired, which may happen early as stores round TTLs.
+		switch {
+		case !dirty:
+			merged = remote
+		case remote == -1:
+			// Unless the key was deleted since it was loaded, for example
+			// by another process resetting it, in which case the local
+			// updates that were made before are dropped instead of
+			// restoring it
+			deleted, err = ts.deletedSince(ctx, key, loaded)
+			if err != nil {
+				return err
+			}
+			merged = value
+			if deleted {
+				merged = -1
+			}
+		default:
+			merged = maxInt64(remote+pending, value)
+		}
+		if merged == remote {
+			break
+		}
+
+		ttl := time.Duration(merged - now.UnixNano())
+		if ttl < 0 {
+			ttl = 0
+		}
+
+		var updated bool
+		if remote == -1 {
+			updated, err = ts.backing.SetIfNotExistsWithTTL(ctx, key, merged, ttl)
+		} else {
+			updated, err = ts.backing.CompareAndSwapWithTTL(ctx, key, remote, merged, ttl)
+		}
+		if err != nil {
+			return err
+		}
+		if updated {
+			break
+		}
+	}
+
+	// Keep the local updates made while synchronizing, unless the key
+	// was deleted or dropped in the meantime
+	ts.mu.Lock()
+	if ts.keys[key] == e {
+		e.remote, e.loaded = merged, synced
+		switch {
+		case deleted:
+			e.value, e.pending, e.synced = -1, 0, e.updates
+		case e.updates == updates:
+			e.value, e.pending, e.synced = merged, e.pending-pending, updates
+		default:
+			e.pending -= pending
+			e.synced = updates
+			if merged != -1 {
+				e.value = maxInt64(merged+e.pending, e.value)
+			}
+		}
+	}
+	ts.mu.Unlock()
+	return nil
+}
+
+// tombstoneSuffix is appended to a key to name the key recording when it
+// was last deleted. It starts with a NUL byte so that it can't collide
+// with the keys used by rate limiters.
+const tombstoneSuffix = "\x00deleted"
+
+// deletedSince reports whether key was deleted by a TieredStore at or
+// after the time of the backing store since, in UnixNano.
+func (ts *TieredStore) deletedSince(ctx context.Context, key string, since int64) (bool, error) {
+	deletedAt, _, err := ts.backing.GetWithTime(ctx, key+tombstoneSuffix)
+	if err != nil {
+		return false, err
+	}
+	return deletedAt != -1 && deletedAt >= since, nil
+}
+
+func (ts *TieredStore) syncer() {
+	defer close(ts.done)
+
+	ticker := time.NewTicker(ts.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Keys that fail to synchronize are retried next time
+			ctx, cancel := context.WithTimeout(context.Background(), ts.syncInterval)
+			ts.Sync(ctx)
+			cancel()
+		case <-ts.stop:
+			return
+		}
+	}
+}
+
+// Close stops the background goroutine and synchronizes the remaining
+// local updates with the backing store, returning the first error that
+// occurs. The store must not be used afterwards.
+func (ts *TieredStore) Close() error {
+	var err error
+	ts.closeOnce.Do(func() {
+		close(ts.stop)
+		<-ts.done
+		err = ts.Sync(context.Background())
+	})
+	return err
+}
+
+// Delete removes key from the backing store and the local copy. The
+// backing store must implement throttled.StoreAdminCtx.
+//
+// Other processes drop their local updates of the key, including those
+// they make until then, when they next synchronize it instead of
+// restoring it. To tell the deletion apart from the key expiring, the
+// time of the deletion is recorded in the backing store under the key
+// followed by a NUL byte and "deleted" until the key would have expired
+// plus syncInterval, so processes are assumed to synchronize at least
+// as often as this one.
+func (ts *TieredStore) Delete(ctx context.Context, key string) error {
+	admin, ok := ts.backing.(throttled.StoreAdminCtx)
+	if !ok {
+		return throttled.ErrAdminNotSupported
+	}
+
+	ts.mu.Lock()
+	e, ok := ts.keys[key]
+	delete(ts.keys, key)
+	ts.mu.Unlock()
+
+	// Wait for a synchronization in progress, which could restore the key
+	var local int64 = -1
+	if ok {
+		e.syncMu.Lock()
+		defer e.syncMu.Unlock()
+
+		ts.mu.Lock()
+		local = e.value
+		ts.mu.Unlock()
+	}
+
+	value, now, err := ts.backing.GetWithTime(ctx, key)
+	if err != nil {
+		return err
+	}
+	ttl := ts.syncInterval
+	if expires := maxInt64(value, local); expires > now.UnixNano() {
+		ttl += time.Duration(expires - now.UnixNano())
+	}
+	if err := ts.setTombstone(ctx, key, now.UnixNano(), ttl); err != nil {
+		return err
+	}
+
+	return admin.Delete(ctx, key)
+}
+
+// setTombstone records in the backing store that key was deleted at the
+// time deletedAt, unless it was recorded to be deleted later.
+func (ts *TieredStore) setTombstone(ctx context.Context, key string, deletedAt int64, ttl time.Duration) error {
+	key += tombstoneSuffix
+	for {
+		old, _, err := ts.backing.GetWithTime(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		var updated bool
+		if old == -1 {
+			updated, err = ts.backing.SetIfNotExistsWithTTL(ctx, key, deletedAt, ttl)
+		} else {
+			updated, err = ts.backing.CompareAndSwapWithTTL(ctx, key, old, maxInt64(old, deletedAt), ttl)
+		}
+		if err != nil || updated {
+			return err
+		}
+	}
+}
+
+// Keys synchronizes the local updates and returns the keys starting with
+// prefix in the backing store, which must implement
+// throttled.StoreAdminCtx, leaving out the keys recording deletions.
+func (ts *TieredStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	admin, ok := ts.backing.(throttled.StoreAdminCtx)
+	if !ok {
+		return nil, throttled.ErrAdminNotSupported
+	}
+	if err := ts.Sync(ctx); err != nil {
+		return nil, err
+	}
+
+	keys, err := admin.Keys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	filtered := keys[:0]
+	for _, key := range keys {
+		if !strings.HasSuffix(key, tombstoneSuffix) {
+			filtered = append(filtered, key)
+		}
+	}
+	return filtered, nil
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func abs(a int64) int64 {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
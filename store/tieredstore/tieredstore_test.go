@@ -0,0 +1,414 @@
+package tieredstore_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled/v2"
+	"github.com/throttled/throttled/v2/store/memstore"
+	"github.com/throttled/throttled/v2/store/storetest"
+	"github.com/throttled/throttled/v2/store/tieredstore"
+)
+
+// countingStore counts the reads of the backing store.
+type countingStore struct {
+	throttled.GCRAStoreCtx
+	reads int32
+}
+
+func (cs *countingStore) GetWithTime(ctx context.Context, key string) (int64, time.Time, error) {
+	atomic.AddInt32(&cs.reads, 1)
+	return cs.GCRAStoreCtx.GetWithTime(ctx, key)
+}
+
+// blockingStore blocks the updates of the key "slow" until release is
+// closed, closing blocked once they do.
+type blockingStore struct {
+	throttled.GCRAStoreCtx
+	blocked, release chan struct{}
+}
+
+func (bs *blockingStore) SetIfNotExistsWithTTL(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	if key == "slow" {
+		close(bs.blocked)
+		<-bs.release
+	}
+	return bs.GCRAStoreCtx.SetIfNotExistsWithTTL(ctx, key, value, ttl)
+}
+
+// hangingStore doesn't respond to the updates of the key "slow" until
+// their context is done or release is closed, counting them in calls.
+type hangingStore struct {
+	throttled.GCRAStoreCtx
+	release chan struct{}
+	calls   int32
+}
+
+func (hs *hangingStore) SetIfNotExistsWithTTL(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	if key == "slow" {
+		atomic.AddInt32(&hs.calls, 1)
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-hs.release:
+		}
+	}
+	return hs.GCRAStoreCtx.SetIfNotExistsWithTTL(ctx, key, value, ttl)
+}
+
+// expiringStore expires keys once their TTL, truncated to whole seconds
+// like Redis does, has passed.
+type expiringStore struct {
+	throttled.GCRAStoreCtx
+
+	mu      sync.Mutex
+	expires map[string]time.Time
+}
+
+func (es *expiringStore) GetWithTime(ctx context.Context, key string) (int64, time.Time, error) {
+	v, now, err := es.GCRAStoreCtx.GetWithTime(ctx, key)
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if expires, ok := es.expires[key]; ok && !now.Before(expires) {
+		v = -1
+	}
+	return v, now, err
+}
+
+func (es *expiringStore) SetIfNotExistsWithTTL(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	if v, _, err := es.GetWithTime(ctx, key); err != nil || v != -1 {
+		return false, err
+	}
+	if err := es.GCRAStoreCtx.(throttled.StoreAdminCtx).Delete(ctx, key); err != nil {
+		return false, err
+	}
+	updated, err := es.GCRAStoreCtx.SetIfNotExistsWithTTL(ctx, key, value, ttl)
+	if updated {
+		es.expire(key, ttl)
+	}
+	return updated, err
+}
+
+func (es *expiringStore) CompareAndSwapWithTTL(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	if v, _, err := es.GetWithTime(ctx, key); err != nil || v != old {
+		return false, err
+	}
+	updated, err := es.GCRAStoreCtx.CompareAndSwapWithTTL(ctx, key, old, new, ttl)
+	if updated {
+		es.expire(key, ttl)
+	}
+	return updated, err
+}
+
+func (es *expiringStore) expire(key string, ttl time.Duration) {
+	es.mu.Lock()
+	es.expires[key] = time.Now().Add(ttl.Truncate(time.Second))
+	es.mu.Unlock()
+}
+
+func TestTieredStore(t *testing.T) {
+	backing, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := tieredstore.NewCtx(backing, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	storetest.TestGCRAStoreCtx(t, st)
+	storetest.TestStoreAdminCtx(t, st)
+}
+
+func newLimiter(t *testing.T, st throttled.GCRAStoreCtx) *throttled.GCRARateLimiterCtx {
+	quota := throttled.RateQuota{MaxRate: throttled.PerHour(60), MaxBurst: 9}
+	rl, err := throttled.NewGCRARateLimiterCtx(st, quota)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rl
+}
+
+func rateLimit(t *testing.T, rl *throttled.GCRARateLimiterCtx, quantity int) throttled.RateLimitResult {
+	_, result, err := rl.RateLimitCtx(context.Background(), "foo", quantity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestTieredStoreSync(t *testing.T) {
+	ctx := context.Background()
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backing := &countingStore{GCRAStoreCtx: mst}
+
+	a, err := tieredstore.NewCtx(backing, time.Hour, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := tieredstore.NewCtx(backing, time.Hour, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	rlA, rlB := newLimiter(t, a), newLimiter(t, b)
+
+	// Decisions are made locally once a key is loaded
+	for i := 0; i < 3; i++ {
+		rateLimit(t, rlA, 1)
+	}
+	if have := atomic.LoadInt32(&backing.reads); have != 1 {
+		t.Errorf("expected the backing store to be read once but got %d", have)
+	}
+	if err := a.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := rateLimit(t, rlB, 1).Remaining, 6; have != want {
+		t.Errorf("expected %d remaining after loading the synchronized key but got %d", want, have)
+	}
+	rateLimit(t, rlB, 2)
+	rateLimit(t, rlA, 1)
+
+	// Each store only knows its own updates until they are synchronized
+	if have, want := rateLimit(t, rlA, 0).Remaining, 6; have != want {
+		t.Errorf("expected %d remaining before synchronizing but got %d", want, have)
+	}
+	for _, st := range []*tieredstore.TieredStore{a, b, a} {
+		if err := st.Sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, rl := range []*throttled.GCRARateLimiterCtx{rlA, rlB} {
+		if have, want := rateLimit(t, rl, 0).Remaining, 3; have != want {
+			t.Errorf("expected %d remaining after synchronizing but got %d", want, have)
+		}
+	}
+}
+
+func TestTieredStoreEarlyExpiry(t *testing.T) {
+	ctx := context.Background()
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backing := &expiringStore{GCRAStoreCtx: mst, expires: make(map[string]time.Time)}
+	st, err := tieredstore.NewCtx(backing, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	quota := throttled.RateQuota{MaxRate: throttled.PerSec(2), MaxBurst: 1}
+	rl, err := throttled.NewGCRARateLimiterCtx(st, quota)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each synchronized value expires in the backing store right away,
+	// long before the key returns to its initial state
+	for i, want := range []int{1, 0} {
+		_, result, err := rl.RateLimitCtx(ctx, "foo", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Remaining != want {
+			t.Errorf("%d: expected %d remaining but got %d", i, want, result.Remaining)
+		}
+		if err := st.Sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if limited, _, err := rl.RateLimitCtx(ctx, "foo", 1); err != nil {
+		t.Fatal(err)
+	} else if !limited {
+		t.Error("expected the local updates to be kept after the key expired early")
+	}
+}
+
+func TestTieredStoreMaxError(t *testing.T) {
+	ctx := context.Background()
+	backing, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := tieredstore.NewCtx(backing, time.Hour, 2*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	rl := newLimiter(t, st)
+
+	synced := func() time.Duration {
+		v, now, err := backing.GetWithTime(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v == -1 {
+			return 0
+		}
+		return time.Unix(0, v).Sub(now).Round(time.Minute)
+	}
+
+	// An update exceeding maxError on its own is synchronized right away
+	for i, c := range []struct {
+		quantity int
+		want     time.Duration
+	}{
+		{1, 0},
+		{1, 0},
+		{1, 2 * time.Minute},
+		{1, 2 * time.Minute},
+		{1, 4 * time.Minute},
+		{3, 8 * time.Minute},
+		{1, 8 * time.Minute},
+	} {
+		rateLimit(t, rl, c.quantity)
+		if have := synced(); have != c.want {
+			t.Errorf("%d: expected the backing store to be %s ahead but got %s", i, c.want, have)
+		}
+	}
+
+	// Close sends the remaining updates
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := synced(), 9*time.Minute; have != want {
+		t.Errorf("expected the backing store to be %s ahead but got %s", want, have)
+	}
+}
+
+func TestTieredStoreBackground(t *testing.T) {
+	backing, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := tieredstore.NewCtx(backing, 10*time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	rateLimit(t, newLimiter(t, st), 1)
+	time.Sleep(50 * time.Millisecond)
+	if v, _, err := backing.GetWithTime(context.Background(), "foo"); err != nil {
+		t.Fatal(err)
+	} else if v == -1 {
+		t.Error("expected the update to be synchronized in the background")
+	}
+}
+
+func TestTieredStoreBackgroundDeadline(t *testing.T) {
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backing := &hangingStore{GCRAStoreCtx: mst, release: make(chan struct{})}
+	st, err := tieredstore.NewCtx(backing, 10*time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	defer close(backing.release)
+
+	if _, err := st.SetIfNotExistsWithTTL(context.Background(), "slow", time.Now().Add(time.Minute).UnixNano(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// The synchronization is given up and retried
+	time.Sleep(100 * time.Millisecond)
+	if calls := atomic.LoadInt32(&backing.calls); calls < 2 {
+		t.Errorf("expected the synchronization to be retried but it was attempted %d times", calls)
+	}
+}
+
+func TestTieredStoreSlowKey(t *testing.T) {
+	ctx := context.Background()
+	mst, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backing := &blockingStore{GCRAStoreCtx: mst, blocked: make(chan struct{}), release: make(chan struct{})}
+	st, err := tieredstore.NewCtx(backing, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	slow := make(chan error, 1)
+	go func() {
+		_, err := st.SetIfNotExistsWithTTL(ctx, "slow", time.Now().Add(time.Minute).UnixNano(), time.Minute)
+		slow <- err
+	}()
+	<-backing.blocked
+
+	// Other keys are synchronized while the slow one waits
+	fast := make(chan error, 1)
+	go func() {
+		_, err := st.SetIfNotExistsWithTTL(ctx, "fast", time.Now().Add(time.Minute).UnixNano(), time.Minute)
+		fast <- err
+	}()
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected a key to be synchronized while another one is slow")
+	}
+
+	close(backing.release)
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTieredStoreDelete(t *testing.T) {
+	ctx := context.Background()
+	backing, err := memstore.NewCtx(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := tieredstore.NewCtx(backing, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := tieredstore.NewCtx(backing, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	rlA, rlB := newLimiter(t, a), newLimiter(t, b)
+
+	rateLimit(t, rlA, 5)
+	if err := a.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rateLimit(t, rlB, 1)
+
+	// The pending update of b doesn't restore the deleted key
+	if err := a.Delete(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, err := backing.GetWithTime(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	} else if v != -1 {
+		t.Error("expected the deleted key not to be restored")
+	}
+	if have, want := rateLimit(t, rlB, 0).Remaining, 10; have != want {
+		t.Errorf("expected %d remaining after the key was deleted but got %d", want, have)
+	}
+}
@@ -2,7 +2,17 @@ package throttled
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
 )
 
@@ -11,6 +21,22 @@ type VaryBy struct {
 	// Vary by the RemoteAddr as specified by the net/http.Request field.
 	RemoteAddr bool
 
+	// Vary by the IP address of the client as determined by ClientIP,
+	// which can take the addresses reported by trusted proxies into
+	// account.
+	ClientIP *ClientIP
+
+	// Mask the IPv4 addresses used by RemoteAddr and ClientIP to this
+	// prefix length, such as 24, so that all addresses of a network share
+	// a key. The key then contains the network in CIDR notation, such as
+	// 192.0.2.0/24. IPv4-mapped IPv6 addresses are masked as IPv4
+	// addresses. Addresses are not masked if it is zero.
+	IPv4Prefix int
+
+	// Mask the IPv6 addresses used by RemoteAddr and ClientIP to this
+	// prefix length, such as 64 or 56, like IPv4Prefix.
+	IPv6Prefix int
+
 	// Vary by the HTTP Method as specified by the net/http.Request field.
 	Method bool
 
@@ -18,12 +44,33 @@ type VaryBy struct {
 	// URL field.
 	Path bool
 
+	// Normalize the path used by Path with this PathNormalizer, so that
+	// requests to the same route share a key.
+	PathNormalizer *PathNormalizer
+
 	// Vary by this list of header names, read from the net/http.Request Header field.
 	Headers []string
 
 	// Vary by this list of parameters, read from the net/http.Request FormValue method.
+	// FormValue parses the request body, which the handler can then no
+	// longer read. QueryParams and BodyParams avoid this.
 	Params []string
 
+	// Vary by this list of parameters, read from the query string only.
+	// Unlike Params, the request body is never read.
+	QueryParams []string
+
+	// Vary by this list of parameters, read from request bodies that are
+	// either form encoded or JSON objects, of which top-level values are
+	// used. At most MaxBodySize bytes of the body are read, and the body
+	// is restored for the handler to read in full.
+	BodyParams []string
+
+	// The maximum size of the request body read for BodyParams. Bodies
+	// that are larger don't provide any parameters. Defaults to 64 KiB if
+	// zero.
+	MaxBodySize int64
+
 	// Vary by this list of cookie names, read from the net/http.Request Cookie method.
 	Cookies []string
 
@@ -31,6 +78,21 @@ type VaryBy struct {
 	// Defaults to a newline character if empty (\n).
 	Separator string
 
+	// Hash the key with SHA-256, so that it has a fixed length and the
+	// values it is composed of, which may be secrets like session
+	// cookies, are not stored. The hash is hex encoded.
+	Hash bool
+
+	// Hash the key with HMAC-SHA256 using this secret instead of plain
+	// SHA-256, so that the values can't be recovered by hashing guesses.
+	// Implies Hash.
+	HashSecret []byte
+
+	// Prefix the key with this string, such as "login:", which keeps
+	// hashed keys readable and separates the keys of different limiters
+	// sharing a store.
+	Prefix string
+
 	// DEPRECATED. Custom specifies the custom-generated key to use for this request.
 	// If not nil, the value returned by this function is used instead of any
 	// VaryBy criteria.
@@ -52,7 +114,13 @@ func (vb *VaryBy) Key(r *http.Request) string {
 	if sep == "" {
 		sep = "\n" // Separator defaults to newline
 	}
-	if vb.RemoteAddr && len(r.RemoteAddr) > 0 {
+	var remoteIP net.IP
+	if vb.RemoteAddr && vb.masking() {
+		remoteIP = parseAddr(r.RemoteAddr)
+	}
+	if remoteIP != nil {
+		buf.WriteString(vb.maskIP(remoteIP) + sep)
+	} else if vb.RemoteAddr && len(r.RemoteAddr) > 0 {
 		// RemoteAddr usually looks something like `IP:port`. For example,
 		// `[::]:1234`. However, it seems to occasionally degenerately appear
 		// as just IP (or other), so be conservative with how we extract it.
@@ -67,6 +135,9 @@ func (vb *VaryBy) Key(r *http.Request) string {
 
 		buf.WriteString(strings.ToLower(ip) + sep)
 	}
+	if vb.ClientIP != nil {
+		buf.WriteString(vb.maskIP(vb.ClientIP.IP(r)) + sep)
+	}
 	if vb.Method {
 		buf.WriteString(strings.ToLower(r.Method) + sep)
 	}
@@ -74,11 +145,23 @@ func (vb *VaryBy) Key(r *http.Request) string {
 		buf.WriteString(strings.ToLower(r.Header.Get(h)) + sep)
 	}
 	if vb.Path {
-		buf.WriteString(r.URL.Path + sep)
+		buf.WriteString(vb.PathNormalizer.Normalize(r.URL.Path) + sep)
 	}
 	for _, p := range vb.Params {
 		buf.WriteString(r.FormValue(p) + sep)
 	}
+	if len(vb.QueryParams) > 0 {
+		query := r.URL.Query()
+		for _, p := range vb.QueryParams {
+			buf.WriteString(query.Get(p) + sep)
+		}
+	}
+	if len(vb.BodyParams) > 0 {
+		params := vb.bodyParams(r)
+		for _, p := range vb.BodyParams {
+			buf.WriteString(params[p] + sep)
+		}
+	}
 	for _, c := range vb.Cookies {
 		ck, err := r.Cookie(c)
 		if err == nil {
@@ -86,5 +169,109 @@ func (vb *VaryBy) Key(r *http.Request) string {
 		}
 		buf.WriteString(sep) // Write the separator anyway, whether or not the cookie exists
 	}
-	return buf.String()
+	if vb.HashSecret != nil || vb.Hash {
+		return vb.Prefix + vb.hash(buf.Bytes())
+	}
+	return vb.Prefix + buf.String()
+}
+
+// hash returns the hex encoded SHA-256 hash or HMAC of key.
+func (vb *VaryBy) hash(key []byte) string {
+	var h hash.Hash
+	if vb.HashSecret != nil {
+		h = hmac.New(sha256.New, vb.HashSecret)
+	} else {
+		h = sha256.New()
+	}
+	h.Write(key)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (vb *VaryBy) masking() bool {
+	return vb.IPv4Prefix > 0 || vb.IPv6Prefix > 0
+}
+
+// maskIP returns the network of ip with the prefix length configured for
+// its family, or ip itself if it is not masked. It returns an empty
+// string for a nil ip.
+func (vb *VaryBy) maskIP(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+
+	bits, prefix := 8*net.IPv6len, vb.IPv6Prefix
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, prefix = ip4, 8*net.IPv4len, vb.IPv4Prefix
+	}
+	if prefix <= 0 || prefix > bits {
+		return ip.String()
+	}
+
+	mask := net.CIDRMask(prefix, bits)
+	n := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	return n.String()
+}
+
+const defaultMaxBodySize = 64 << 10
+
+// bodyParams returns the parameters in the body of r, or nil if it can't
+// be read.
+func (vb *VaryBy) bodyParams(r *http.Request) map[string]string {
+	maxBodySize := vb.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = defaultMaxBodySize
+	}
+	body, ok := peekBody(r, maxBodySize)
+	if !ok {
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil
+		}
+		params := make(map[string]string, len(values))
+		for k := range values {
+			params[k] = values.Get(k)
+		}
+		return params
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(body, &values); err != nil {
+			return nil
+		}
+		params := make(map[string]string, len(values))
+		for k, v := range values {
+			var s string
+			if err := json.Unmarshal(v, &s); err == nil {
+				params[k] = s
+			} else {
+				params[k] = string(v)
+			}
+		}
+		return params
+	}
+	return nil
+}
+
+// peekBody reads up to maxBodySize bytes of the body of r and restores
+// it so that it can be read again in full. It returns false if the body
+// is missing, can't be read or is larger than maxBodySize.
+func peekBody(r *http.Request, maxBodySize int64) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil || int64(len(body)) > maxBodySize {
+		return nil, false
+	}
+	return body, true
 }
@@ -1,8 +1,11 @@
 package throttled_test
 
 import (
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/throttled/throttled/v2"
@@ -63,6 +66,56 @@ func TestVaryBy(t *testing.T) {
 			&http.Request{Header: http.Header{"Cookie": []string{ck.String()}}},
 			"blah",
 		},
+		9: {
+			&throttled.VaryBy{ClientIP: &throttled.ClientIP{Header: "X-Forwarded-For", TrustedHops: 2}, Method: true},
+			&http.Request{Method: "GET", RemoteAddr: "[::ffff:a00:1]:1234", Header: http.Header{"X-Forwarded-For": {"1.2.3.4"}}},
+			"1.2.3.4\nget\n",
+		},
+		10: {
+			&throttled.VaryBy{RemoteAddr: true, IPv4Prefix: 24, IPv6Prefix: 64},
+			&http.Request{RemoteAddr: "[2001:DB8:1:2:3::4]:1234"},
+			"2001:db8:1:2::/64\n",
+		},
+		11: {
+			&throttled.VaryBy{RemoteAddr: true, IPv4Prefix: 24, IPv6Prefix: 56},
+			&http.Request{RemoteAddr: "[::ffff:192.0.2.77]:1234"},
+			"192.0.2.0/24\n",
+		},
+		12: {
+			&throttled.VaryBy{RemoteAddr: true, IPv6Prefix: 48},
+			&http.Request{RemoteAddr: "192.0.2.77:1234"},
+			"192.0.2.77\n",
+		},
+		13: {
+			&throttled.VaryBy{ClientIP: &throttled.ClientIP{}, IPv4Prefix: 16},
+			&http.Request{RemoteAddr: "192.0.2.77:1234"},
+			"192.0.0.0/16\n",
+		},
+		14: {
+			&throttled.VaryBy{RemoteAddr: true, IPv4Prefix: 24},
+			&http.Request{RemoteAddr: "Unix"},
+			"unix\n",
+		},
+		15: {
+			&throttled.VaryBy{Path: true, PathNormalizer: &throttled.PathNormalizer{Templates: []string{"/test/{name}"}}},
+			&http.Request{URL: u},
+			"/test/{name}\n",
+		},
+		16: {
+			&throttled.VaryBy{RemoteAddr: true, Prefix: "ip:"},
+			&http.Request{RemoteAddr: "1.2.3.4:1234"},
+			"ip:1.2.3.4\n",
+		},
+		17: {
+			&throttled.VaryBy{RemoteAddr: true, Hash: true, Prefix: "ip:"},
+			&http.Request{RemoteAddr: "1.2.3.4:1234"},
+			"ip:aa37bedc19a1ce97d6997e9e719cf5cafb40291ac7d3b4e1018eeb2e7a788d18",
+		},
+		18: {
+			&throttled.VaryBy{RemoteAddr: true, HashSecret: []byte("secret")},
+			&http.Request{RemoteAddr: "1.2.3.4:1234"},
+			"f7ef464ccdb4de1605affd78434fb05b74103b644e63ecc63914b3ffcc0c5238",
+		},
 	}
 	for i, c := range cases {
 		got := c.vb.Key(c.r)
@@ -71,3 +124,41 @@ func TestVaryBy(t *testing.T) {
 		}
 	}
 }
+
+func TestVaryByQueryAndBodyParams(t *testing.T) {
+	vb := &throttled.VaryBy{
+		QueryParams: []string{"q", "user"},
+		BodyParams:  []string{"user", "n"},
+		MaxBodySize: 64,
+	}
+
+	for i, c := range []struct {
+		contentType, body string
+		k                 string
+	}{
+		0: {"application/x-www-form-urlencoded", "user=body&n=1", "s,,body,1,"},
+		1: {"application/json; charset=utf-8", `{"user": "json", "n": 2, "x": {}}`, "s,,json,2,"},
+		2: {"application/json", `{"user": "` + strings.Repeat("x", 64) + `"}`, "s,,,,"},
+		3: {"text/plain", "user=text", "s,,,,"},
+		4: {"application/json", `not json`, "s,,,,"},
+	} {
+		r := httptest.NewRequest("POST", "/test?q=s", strings.NewReader(c.body))
+		r.Header.Set("Content-Type", c.contentType)
+		vb.Separator = ","
+		if have := vb.Key(r); have != c.k {
+			t.Errorf("%d: expected '%s' but got '%s'", i, c.k, have)
+		}
+
+		// The handler can still read the whole body
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != c.body {
+			t.Errorf("%d: expected the body to be restored but got %s", i, body)
+		}
+		if r.Form != nil {
+			t.Errorf("%d: expected the form not to be parsed", i)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package throttled
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// SlidingWindowRateLimiterCtx is a RateLimiterCtx that permits a number
+// of requests per window of time using the sliding window counter
+// algorithm. It counts requests in fixed windows and estimates the
+// number of requests in the window of time ending now by weighting the
+// count of the previous window by how much of it overlaps with that
+// window. This smooths out the bursts at window boundaries that a
+// FixedWindowRateLimiterCtx allows.
+type SlidingWindowRateLimiterCtx struct {
+	windowRateLimiter
+}
+
+// FixedWindowRateLimiterCtx is a RateLimiterCtx that permits a number
+// of requests per calendar window of time, such as 1000 requests per
+// hour starting on the hour. Note that a client can make up to twice
+// the limit in a short time around the boundary between two windows.
+type FixedWindowRateLimiterCtx struct {
+	windowRateLimiter
+}
+
+// NewSlidingWindowRateLimiterCtx creates a SlidingWindowRateLimiterCtx
+// that permits the number of requests given by rate in any window of
+// time of the length given by rate. For example, PerHour(1000) permits
+// 1000 requests in any hour.
+func NewSlidingWindowRateLimiterCtx(st WindowStoreCtx, rate Rate) (*SlidingWindowRateLimiterCtx, error) {
+	w, err := newWindowRateLimiter(st, rate)
+	if err != nil {
+		return nil, err
+	}
+	return &SlidingWindowRateLimiterCtx{w}, nil
+}
+
+// NewFixedWindowRateLimiterCtx creates a FixedWindowRateLimiterCtx that
+// permits the number of requests given by rate in each window of time
+// of the length given by rate. For example, PerHour(1000) permits 1000
+// requests between the start of each hour and the next.
+func NewFixedWindowRateLimiterCtx(st WindowStoreCtx, rate Rate) (*FixedWindowRateLimiterCtx, error) {
+	w, err := newWindowRateLimiter(st, rate)
+	if err != nil {
+		return nil, err
+	}
+	return &FixedWindowRateLimiterCtx{w}, nil
+}
+
+// RateLimitCtx checks whether a particular key has exceeded a rate
+// limit. It also returns a RateLimitResult to provide additional
+// information about the state of the RateLimiter.
+//
+// If the rate limit has not been exceeded, the count for the current
+// window is increased by the supplied quantity. If quantity is 0, no
+// update is performed allowing you to "peek" at the state of the
+// RateLimiter for a given key.
+func (s *SlidingWindowRateLimiterCtx) RateLimitCtx(ctx context.Context, key string, quantity int) (bool, RateLimitResult, error) {
+	return s.rateLimit(ctx, key, quantity, true)
+}
+
+// RateLimitCtx checks whether a particular key has exceeded a rate
+// limit. It also returns a RateLimitResult to provide additional
+// information about the state of the RateLimiter.
+//
+// If the rate limit has not been exceeded, the count for the current
+// window is increased by the supplied quantity. If quantity is 0, no
+// update is performed allowing you to "peek" at the state of the
+// RateLimiter for a given key.
+func (f *FixedWindowRateLimiterCtx) RateLimitCtx(ctx context.Context, key string, quantity int) (bool, RateLimitResult, error) {
+	return f.rateLimit(ctx, key, quantity, false)
+}
+
+// PeekCtx returns the state of key without updating it, with RetryAfter
+// set to the time until quantity would be permitted, or -1 if it would
+// be permitted now or never.
+func (s *SlidingWindowRateLimiterCtx) PeekCtx(ctx context.Context, key string, quantity int) (RateLimitResult, error) {
+	return s.peek(ctx, key, quantity, true)
+}
+
+// PeekCtx returns the state of key without updating it, with RetryAfter
+// set to the time until quantity would be permitted, or -1 if it would
+// be permitted now or never.
+func (f *FixedWindowRateLimiterCtx) PeekCtx(ctx context.Context, key string, quantity int) (RateLimitResult, error) {
+	return f.peek(ctx, key, quantity, false)
+}
+
+// windowRateLimiter implements both window based rate limiters, which
+// only differ in whether the previous window is taken into account.
+type windowRateLimiter struct {
+	rate   Rate
+	limit  int
+	window time.Duration
+	store  WindowStoreCtx
+}
+
+func newWindowRateLimiter(st WindowStoreCtx, rate Rate) (windowRateLimiter, error) {
+	if rate.count <= 0 || rate.period <= 0 {
+		return windowRateLimiter{}, fmt.Errorf("invalid Rate %#v; Rate must be greater than zero", rate)
+	}
+
+	return windowRateLimiter{
+		rate:   rate,
+		limit:  rate.count,
+		window: rate.window,
+		store:  st,
+	}, nil
+}
+
+// QuotaCtx returns the quota enforced by the limiter, which is the same
+// for all keys. Its MaxBurst is one less than the number of requests
+// permitted per window, so that the burst and the rate describe the
+// window.
+func (w *windowRateLimiter) QuotaCtx(_ context.Context, _ string) (RateQuota, error) {
+	return RateQuota{MaxRate: w.rate, MaxBurst: w.limit - 1}, nil
+}
+
+func (w *windowRateLimiter) rateLimit(ctx context.Context, key string, quantity int, sliding bool) (bool, RateLimitResult, error) {
+	rlc := RateLimitResult{Limit: w.limit, RetryAfter: -1}
+	limit := int64(w.limit)
+	delta := int64(quantity)
+
+	cur, prev, now, err := w.store.IncrementWithTime(ctx, key, w.window, delta)
+	if err != nil {
+		return false, rlc, err
+	}
+	if !sliding {
+		prev = 0
+	}
+
+	elapsed := time.Duration(now.UnixNano() % int64(w.window))
+	count := w.estimate(cur, prev, elapsed)
+
+	limited := false
+	if delta > 0 && count > limit {
+		// Give back what was just added. Until this is done, concurrent
+		// requests for the key may see a count that is slightly too high.
+		if err := w.store.IncrementAt(ctx, key, w.window, now, -delta); err != nil {
+			return false, rlc, err
+		}
+
+		cur -= delta
+		count = w.estimate(cur, prev, elapsed)
+		limited = true
+		if delta <= limit {
+			rlc.RetryAfter = w.retryAfter(cur, prev, delta, elapsed, sliding)
+		}
+	}
+
+	w.describe(&rlc, cur, prev, count, elapsed, sliding)
+	return limited, rlc, nil
+}
+
+// peek implements PeekCtx.
+func (w *windowRateLimiter) peek(ctx context.Context, key string, quantity int, sliding bool) (RateLimitResult, error) {
+	rlc := RateLimitResult{Limit: w.limit, RetryAfter: -1}
+	limit := int64(w.limit)
+	q := int64(quantity)
+
+	cur, prev, now, err := w.store.IncrementWithTime(ctx, key, w.window, 0)
+	if err != nil {
+		return rlc, err
+	}
+	if !sliding {
+		prev = 0
+	}
+
+	elapsed := time.Duration(now.UnixNano() % int64(w.window))
+	count := w.estimate(cur, prev, elapsed)
+	if q <= limit && count+q > limit {
+		rlc.RetryAfter = w.retryAfter(cur, prev, q, elapsed, sliding)
+	}
+
+	w.describe(&rlc, cur, prev, count, elapsed, sliding)
+	return rlc, nil
+}
+
+// describe sets the Remaining and ResetAfter fields of rlc from the
+// counts of the windows.
+func (w *windowRateLimiter) describe(rlc *RateLimitResult, cur, prev, count int64, elapsed time.Duration, sliding bool) {
+	if limit := int64(w.limit); count < limit {
+		rlc.Remaining = int(limit - count)
+	}
+
+	switch {
+	case cur > 0 && sliding:
+		// The current window is only forgotten at the end of the next one
+		rlc.ResetAfter = 2*w.window - elapsed
+	case cur > 0 || prev > 0:
+		rlc.ResetAfter = w.window - elapsed
+	}
+}
+
+// estimate returns the number of requests in the window of time ending
+// elapsed into the current window, assuming that the requests of the
+// previous window were evenly spread over it.
+func (w *windowRateLimiter) estimate(cur, prev int64, elapsed time.Duration) int64 {
+	weight := 1 - float64(elapsed)/float64(w.window)
+	return cur + int64(float64(prev)*weight)
+}
+
+// retryAfter returns the time until quantity would be permitted given
+// the current counts.
+func (w *windowRateLimiter) retryAfter(cur, prev, quantity int64, elapsed time.Duration, sliding bool) time.Duration {
+	limit := int64(w.limit)
+	untilNext := w.window - elapsed
+
+	if !sliding {
+		return untilNext
+	}
+
+	// If the current window has room, wait until enough of the previous
+	// window has slid out of view
+	if room := limit - cur - quantity; room >= 0 && prev > 0 {
+		at := w.fractionOf(1 - float64(room)/float64(prev))
+		if at > elapsed {
+			return at - elapsed
+		}
+		return 0
+	}
+
+	// Otherwise wait until enough of the current window has slid out of
+	// view after it becomes the previous window
+	if cur <= 0 {
+		return untilNext
+	}
+	return untilNext + w.fractionOf(1-float64(limit-quantity)/float64(cur))
+}
+
+// fractionOf returns the given fraction of the window, rounded up.
+func (w *windowRateLimiter) fractionOf(f float64) time.Duration {
+	return time.Duration(math.Ceil(f * float64(w.window)))
+}
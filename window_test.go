@@ -0,0 +1,130 @@
+package throttled_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled/v2"
+	"github.com/throttled/throttled/v2/store/memstore"
+)
+
+type windowTestCase struct {
+	now               time.Time
+	volume, remaining int
+	reset, retry      time.Duration
+	limited           bool
+}
+
+func TestSlidingWindowRateLimit(t *testing.T) {
+	start := time.Unix(1000, 0)
+	cases := []windowTestCase{
+		0: {start, 10, 0, 2 * time.Second, -1, false},
+		1: {start, 1, 0, 2 * time.Second, 1100 * time.Millisecond, true},
+		// Half of the previous window is still in view
+		2: {start.Add(1500 * time.Millisecond), 3, 2, 1500 * time.Millisecond, -1, false},
+		3: {start.Add(1500 * time.Millisecond), 3, 2, 1500 * time.Millisecond, 100 * time.Millisecond, true},
+		// Requests larger than the limit can never be permitted
+		4: {start.Add(1500 * time.Millisecond), 11, 2, 1500 * time.Millisecond, -1, true},
+		5: {start.Add(1600 * time.Millisecond), 3, 0, 1400 * time.Millisecond, -1, false},
+		// Zero-volume request just peeks at the state
+		6: {start.Add(2500 * time.Millisecond), 0, 7, 500 * time.Millisecond, -1, false},
+		7: {start.Add(3500 * time.Millisecond), 0, 10, 0, -1, false},
+	}
+
+	st, clock := newWindowTestStore(t)
+	rl, err := throttled.NewSlidingWindowRateLimiterCtx(st, throttled.PerSec(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runWindowTestCases(t, rl, 10, clock, cases)
+}
+
+func TestFixedWindowRateLimit(t *testing.T) {
+	start := time.Unix(1000, 0)
+	cases := []windowTestCase{
+		0: {start, 10, 0, time.Second, -1, false},
+		1: {start.Add(500 * time.Millisecond), 1, 0, 500 * time.Millisecond, 500 * time.Millisecond, true},
+		2: {start.Add(500 * time.Millisecond), 11, 0, 500 * time.Millisecond, -1, true},
+		// The whole limit is available again in the next window
+		3: {start.Add(time.Second), 10, 0, time.Second, -1, false},
+		4: {start.Add(2500 * time.Millisecond), 4, 6, 500 * time.Millisecond, -1, false},
+		5: {start.Add(3500 * time.Millisecond), 0, 10, 0, -1, false},
+	}
+
+	st, clock := newWindowTestStore(t)
+	rl, err := throttled.NewFixedWindowRateLimiterCtx(st, throttled.PerSec(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runWindowTestCases(t, rl, 10, clock, cases)
+}
+
+func TestFixedWindowRateLimitUnevenRate(t *testing.T) {
+	// The windows are aligned to the hour even though an hour isn't a
+	// whole number of emission intervals of the rate
+	start := time.Unix(7200, 0)
+	cases := []windowTestCase{
+		0: {start, 7, 0, time.Hour, -1, false},
+		1: {start.Add(30 * time.Minute), 1, 0, 30 * time.Minute, 30 * time.Minute, true},
+		2: {start.Add(time.Hour), 1, 6, time.Hour, -1, false},
+	}
+
+	st, clock := newWindowTestStore(t)
+	rl, err := throttled.NewFixedWindowRateLimiterCtx(st, throttled.PerHour(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runWindowTestCases(t, rl, 7, clock, cases)
+}
+
+func TestWindowRateLimiterInvalidRate(t *testing.T) {
+	st, _ := newWindowTestStore(t)
+	if _, err := throttled.NewSlidingWindowRateLimiterCtx(st, throttled.Rate{}); err == nil {
+		t.Error("expected creating a limiter with a zero Rate to fail")
+	}
+}
+
+func newWindowTestStore(t *testing.T) (*memstore.ShardedStore, *time.Time) {
+	st, err := memstore.NewShardedCtx(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := new(time.Time)
+	st.SetTimeNow(func() time.Time { return *clock })
+	return st, clock
+}
+
+func runWindowTestCases(t *testing.T, rl throttled.RateLimiterCtx, limit int, clock *time.Time, cases []windowTestCase) {
+	for i, c := range cases {
+		*clock = c.now
+
+		limited, result, err := rl.RateLimitCtx(context.Background(), "foo", c.volume)
+		if err != nil {
+			t.Fatalf("%d: %#v", i, err)
+		}
+
+		if limited != c.limited {
+			t.Errorf("%d: expected Limited to be %t but got %t", i, c.limited, limited)
+		}
+
+		if have, want := result.Limit, limit; have != want {
+			t.Errorf("%d: expected Limit to be %d but got %d", i, want, have)
+		}
+
+		if have, want := result.Remaining, c.remaining; have != want {
+			t.Errorf("%d: expected Remaining to be %d but got %d", i, want, have)
+		}
+
+		if have, want := result.ResetAfter, c.reset; have != want {
+			t.Errorf("%d: expected ResetAfter to be %s but got %s", i, want, have)
+		}
+
+		if have, want := result.RetryAfter, c.retry; have != want {
+			t.Errorf("%d: expected RetryAfter to be %s but got %s", i, want, have)
+		}
+	}
+}